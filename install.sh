@@ -40,4 +40,14 @@ systemctl restart sni-panel
 
 echo -e "${GREEN}sni-panel installed!-${BLUE}github.com/ParsaKSH/sni-panel"
 echo -e "panel: http://<server-ip>:8080/<Panel Path>${RESET}"
+# the first start writes users.json, after leaving a generated admin
+# password (only the hash is kept) in a root-only file shown here once
+for _ in $(seq 30); do
+  [ -f /etc/snirouter/users.json ] && break
+  sleep 1
+done
 cat /etc/snirouter/ADMIN.txt
+if [ -f /etc/snirouter/initial-password.txt ]; then
+  cat /etc/snirouter/initial-password.txt
+  rm -f /etc/snirouter/initial-password.txt
+fi
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Mapping.ALPN values besides a protocol id. A protocol id matches when it
+// is the client's first (preferred) offered protocol.
+const (
+	alpnAny  = ""
+	alpnNone = "none" // ClientHello without the ALPN extension
+)
+
+var reALPN = regexp.MustCompile(`^[A-Za-z0-9._/-]{1,64}$`)
+
+func validateALPN(a string) error {
+	if a == alpnAny || a == alpnNone {
+		return nil
+	}
+	if a == "other" || !reALPN.MatchString(a) {
+		return fmt.Errorf("invalid alpn %q", a)
+	}
+	return nil
+}
+
+// generateALPNMap classifies $ssl_preread_alpn_protocols into "none", one of
+// the protocols used by the routes, or "other".
+func generateALPNMap(v string, routes []streamRoute) string {
+	lines := []string{"        default other;", `        "" none;`}
+	seen := map[string]bool{}
+	for _, rt := range routes {
+		if rt.alpn == alpnAny || rt.alpn == alpnNone || seen[rt.alpn] {
+			continue
+		}
+		seen[rt.alpn] = true
+		lines = append(lines, fmt.Sprintf(`        "~^%s(,|$)" %s;`, regexp.QuoteMeta(rt.alpn), rt.alpn))
+	}
+	return "    map $ssl_preread_alpn_protocols " + v + " {\n" + strings.Join(lines, "\n") + "\n    }\n"
+}
+
+// generateRouteMap emits the map(s) that set v from the server name and, when
+// some route has an ALPN condition, from $alpnVar as well. SNI entries with
+// ALPN variants resolve to a placeholder "@n" first; a second map keyed on
+// "placeholder|alpn" then picks the variant, falls back to the SNI's
+// any-ALPN route (or def) and passes plain values through.
+func generateRouteMap(v, alpnVar, def string, routes []streamRoute, value func(streamRoute) string) string {
+	var keys []string
+	byKey := map[string][]streamRoute{}
+	hasALPN := false
+	for _, rt := range routes {
+		if _, ok := byKey[rt.key]; !ok {
+			keys = append(keys, rt.key)
+		}
+		byKey[rt.key] = append(byKey[rt.key], rt)
+		hasALPN = hasALPN || rt.alpn != alpnAny
+	}
+
+	sniVar := v
+	if hasALPN {
+		sniVar = v + "_sni"
+	}
+	first := []string{"        hostnames;", "        default " + def + ";"}
+	var second []string
+	for i, k := range keys {
+		vs := byKey[k]
+		if len(vs) == 1 && vs[0].alpn == alpnAny {
+			first = append(first, fmt.Sprintf("        %s %s;", k, value(vs[0])))
+			continue
+		}
+		id := fmt.Sprintf("@%d", i+1)
+		first = append(first, fmt.Sprintf("        %s %s;", k, id))
+		fallback := def
+		for _, rt := range vs {
+			if rt.alpn == alpnAny {
+				fallback = value(rt)
+				continue
+			}
+			second = append(second, fmt.Sprintf(`        "%s|%s" %s;`, id, rt.alpn, value(rt)))
+		}
+		second = append(second, fmt.Sprintf(`        "~^%s\|" %s;`, id, fallback))
+	}
+
+	out := "    map $ssl_preread_server_name " + sniVar + " {\n" + strings.Join(first, "\n") + "\n    }\n"
+	if hasALPN {
+		second = append(second, `        "~^(?<snirouter_target>[^@|][^|]*)\|" $snirouter_target;`)
+		out += `    map "` + sniVar + "|" + alpnVar + `" ` + v + " {\n" + strings.Join(second, "\n") + "\n    }\n"
+	}
+	return out
+}
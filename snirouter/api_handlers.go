@@ -2,8 +2,9 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"log"
 	"net/http"
-	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -22,11 +23,26 @@ func handleGetConfig(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleSetDefault(w http.ResponseWriter, r *http.Request) {
-	var in struct{ Upstream string `json:"upstream"` }
+	var in struct {
+		Upstream         string  `json:"upstream"`
+		ProxyProtocol    *bool   `json:"proxy_protocol"`
+		NoSNIUpstream    *string `json:"no_sni_upstream"`
+		RejectUnknownSNI *bool   `json:"reject_unknown_sni"`
+		BlackholeUP      *string `json:"blackhole_upstream"`
+	}
 	if err := json.NewDecoder(r.Body).Decode(&in); err != nil || strings.TrimSpace(in.Upstream) == "" {
 		http.Error(w, "invalid upstream", 400)
 		return
 	}
+	for _, p := range []*string{in.NoSNIUpstream, in.BlackholeUP} {
+		if p != nil {
+			*p = strings.TrimSpace(*p)
+			if strings.ContainsAny(*p, " ;{}\"") {
+				http.Error(w, "invalid upstream "+*p, 400)
+				return
+			}
+		}
+	}
 	configMutex.Lock()
 	cfg, err := loadConfig()
 	if err != nil {
@@ -35,7 +51,19 @@ func handleSetDefault(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	cfg.DefaultUP = strings.TrimSpace(in.Upstream)
-	if err := saveConfig(cfg); err != nil {
+	if in.ProxyProtocol != nil {
+		cfg.DefaultProxyProtocol = *in.ProxyProtocol
+	}
+	if in.NoSNIUpstream != nil {
+		cfg.NoSNIUpstream = *in.NoSNIUpstream
+	}
+	if in.RejectUnknownSNI != nil {
+		cfg.RejectUnknownSNI = *in.RejectUnknownSNI
+	}
+	if in.BlackholeUP != nil {
+		cfg.BlackholeUP = *in.BlackholeUP
+	}
+	if err := saveConfig(cfg, sessionAuthor(r), "set default upstream "+cfg.DefaultUP); err != nil {
 		configMutex.Unlock()
 		http.Error(w, err.Error(), 500)
 		return
@@ -49,15 +77,18 @@ func handleSetDefault(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleAddMapping(w http.ResponseWriter, r *http.Request) {
+	port, err := listenerPort(r.URL.Query().Get("listener"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
 	var m Mapping
 	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
 		http.Error(w, "invalid body", 400)
 		return
 	}
-	m.SNI = strings.TrimSpace(m.SNI)
-	m.Upstream = strings.TrimSpace(m.Upstream)
-	if m.SNI == "" || m.Upstream == "" {
-		http.Error(w, "sni/upstream required", 400)
+	if err := normalizeMapping(&m); err != nil {
+		http.Error(w, err.Error(), 400)
 		return
 	}
 	configMutex.Lock()
@@ -67,18 +98,26 @@ func handleAddMapping(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), 500)
 		return
 	}
-	found := false
-	for i := range cfg.Mappings {
-		if strings.EqualFold(cfg.Mappings[i].SNI, m.SNI) {
-			cfg.Mappings[i].Upstream = m.Upstream
-			found = true
-			break
-		}
+	ms, err := streamMappings(&cfg, port)
+	if err != nil {
+		configMutex.Unlock()
+		http.Error(w, err.Error(), 404)
+		return
 	}
-	if !found {
-		cfg.Mappings = append(cfg.Mappings, m)
+	if other, ok := sniConflict(*ms, m.SNI); ok {
+		configMutex.Unlock()
+		http.Error(w, fmt.Sprintf("sni %q conflicts with existing mapping %q", m.SNI, other), 409)
+		return
+	}
+	upsertMapping(ms, m)
+	target := m.Upstream
+	if m.isGroup() {
+		target = fmt.Sprintf("group of %d", len(m.Servers))
 	}
-	if err := saveConfig(cfg); err != nil {
+	if m.ALPN != alpnAny {
+		target += " (alpn " + m.ALPN + ")"
+	}
+	if err := saveConfig(cfg, sessionAuthor(r), "set mapping "+m.SNI+" -> "+target); err != nil {
 		configMutex.Unlock()
 		http.Error(w, err.Error(), 500)
 		return
@@ -103,6 +142,11 @@ func makeDeleteStreamHandler(base string) http.HandlerFunc {
 			http.Error(w, "missing sni", 400)
 			return
 		}
+		port, err := listenerPort(r.URL.Query().Get("listener"))
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
 
 		configMutex.Lock()
 		cfg, err := loadConfig()
@@ -111,14 +155,22 @@ func makeDeleteStreamHandler(base string) http.HandlerFunc {
 			http.Error(w, err.Error(), 500)
 			return
 		}
-		var out []Mapping
-		for _, x := range cfg.Mappings {
-			if !strings.EqualFold(x.SNI, target) {
+		ms, err := streamMappings(&cfg, port)
+		if err != nil {
+			configMutex.Unlock()
+			http.Error(w, err.Error(), 404)
+			return
+		}
+		// ?alpn= removes a single ALPN variant, otherwise all of them go
+		q := r.URL.Query()
+		out := []Mapping{}
+		for _, x := range *ms {
+			if !strings.EqualFold(x.SNI, target) || (q.Has("alpn") && x.ALPN != q.Get("alpn")) {
 				out = append(out, x)
 			}
 		}
-		cfg.Mappings = out
-		if err := saveConfig(cfg); err != nil {
+		*ms = out
+		if err := saveConfig(cfg, sessionAuthor(r), "delete mapping "+target); err != nil {
 			configMutex.Unlock()
 			http.Error(w, err.Error(), 500)
 			return
@@ -147,7 +199,7 @@ func handleSetDefaultHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	cfg.HTTPEnabled = true
 	cfg.DefaultHTTPUP = strings.TrimSpace(in.Upstream)
-	if err := saveConfig(cfg); err != nil {
+	if err := saveConfig(cfg, sessionAuthor(r), "set default http upstream "+cfg.DefaultHTTPUP); err != nil {
 		configMutex.Unlock()
 		http.Error(w, err.Error(), 500)
 		return
@@ -161,21 +213,13 @@ func handleSetDefaultHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleAddHTTPRoute(w http.ResponseWriter, r *http.Request) {
-	var in struct {
-		Host       string `json:"host"`
-		PathPrefix string `json:"path_prefix"`
-		Upstream   string `json:"upstream"`
-		Fallback   bool   `json:"fallback"`
-	}
+	var in httpRouteInput
 	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
 		http.Error(w, "invalid body", 400)
 		return
 	}
-	in.Host = strings.TrimSpace(in.Host)
-	in.PathPrefix = strings.TrimSpace(in.PathPrefix)
-	in.Upstream = strings.TrimSpace(in.Upstream)
-	if in.Host == "" || in.Upstream == "" || (!in.Fallback && (in.PathPrefix == "" || !strings.HasPrefix(in.PathPrefix, "/"))) {
-		http.Error(w, "host/upstream (and valid path_prefix if not fallback) required", 400)
+	if err := in.normalize(); err != nil {
+		http.Error(w, err.Error(), 400)
 		return
 	}
 
@@ -186,39 +230,8 @@ func handleAddHTTPRoute(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), 500)
 		return
 	}
-	cfg.HTTPEnabled = true
-	found := false
-	for i := range cfg.HTTPHosts {
-		if strings.EqualFold(cfg.HTTPHosts[i].Host, in.Host) {
-			found = true
-			if in.Fallback {
-				cfg.HTTPHosts[i].Fallback = in.Upstream
-			} else {
-				replaced := false
-				for j := range cfg.HTTPHosts[i].Paths {
-					if cfg.HTTPHosts[i].Paths[j].PathPrefix == in.PathPrefix {
-						cfg.HTTPHosts[i].Paths[j].Upstream = in.Upstream
-						replaced = true
-						break
-					}
-				}
-				if !replaced {
-					cfg.HTTPHosts[i].Paths = append(cfg.HTTPHosts[i].Paths, HTTPPath{PathPrefix: in.PathPrefix, Upstream: in.Upstream})
-				}
-			}
-			break
-		}
-	}
-	if !found {
-		nh := HTTPHost{Host: in.Host}
-		if in.Fallback {
-			nh.Fallback = in.Upstream
-		} else {
-			nh.Paths = []HTTPPath{{PathPrefix: in.PathPrefix, Upstream: in.Upstream}}
-		}
-		cfg.HTTPHosts = append(cfg.HTTPHosts, nh)
-	}
-	if err := saveConfig(cfg); err != nil {
+	upsertHTTPRoute(&cfg, in)
+	if err := saveConfig(cfg, sessionAuthor(r), "set http route "+in.Host+in.PathPrefix+" -> "+in.Upstream); err != nil {
 		configMutex.Unlock()
 		http.Error(w, err.Error(), 500)
 		return
@@ -271,7 +284,7 @@ func makeDeleteHTTPRouteHandler(base string) http.HandlerFunc {
 			outHosts = append(outHosts, h)
 		}
 		cfg.HTTPHosts = outHosts
-		if err := saveConfig(cfg); err != nil {
+		if err := saveConfig(cfg, sessionAuthor(r), "delete http route "+host+pathQ); err != nil {
 			configMutex.Unlock()
 			http.Error(w, err.Error(), 500)
 			return
@@ -314,120 +327,1093 @@ func handleInstallNginx(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(204)
 }
 
-func handleXUIStatus(w http.ResponseWriter, r *http.Request) {
+func handleChangePassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	var in struct {
+		Current string `json:"current"`
+		New     string `json:"new"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, "invalid body", 400)
+		return
+	}
+	u, _ := sessionUser(r)
+	if err := changePassword(u.Name, in.Current, in.New); err != nil {
+		code := 400
+		if err == errWrongPassword {
+			code = 403
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+	// anyone else logged in with the old password is logged out
+	c, _ := r.Cookie("sni_sess")
+	sessions.revokeUser(u.Name, c.Value)
+	log.Printf("[auth] %s changed their password", u.Name)
+	w.WriteHeader(204)
+}
+
+func handleMe(w http.ResponseWriter, r *http.Request) {
+	u, _ := sessionUser(r)
 	_ = json.NewEncoder(w).Encode(struct {
-		Present bool   `json:"present"`
-		Path    string `json:"path"`
-	}{Present: xuiPresent(), Path: xuiDBPath})
+		Name          string `json:"name"`
+		Role          string `json:"role"`
+		TOTP          bool   `json:"totp"`
+		RecoveryCodes int    `json:"recovery_codes_left"`
+	}{u.Name, u.Role, u.TOTPSecret != "", len(u.RecoveryCodes)})
 }
 
-func handleXUIScan(w http.ResponseWriter, r *http.Request) {
-	_ = os.MkdirAll(filepath.Dir(cachePath), 0755)
-	_ = writeAtomic(cachePath, []byte("{}"), 0644)
+// handleTOTPSetup starts two-factor enrolment for the caller and returns the
+// secret to add to an authenticator app.
+func handleTOTPSetup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	var in struct {
+		Password string `json:"password"`
+	}
+	_ = json.NewDecoder(r.Body).Decode(&in) // only needed to replace an active secret
+	u, _ := sessionUser(r)
+	if !confirmTOTPReplace(w, u, in.Password) {
+		return
+	}
+	secret, err := beginTOTP(u.Name)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}{secret, totpURI(secret, u.Name, "SNI Router")})
+}
 
-	items, err := scanXUI()
+// handleTOTPEnable confirms enrolment with a first code and returns the
+// recovery codes, which are not shown again.
+func handleTOTPEnable(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	var in struct {
+		Code     string `json:"code"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, "invalid body", 400)
+		return
+	}
+	u, _ := sessionUser(r)
+	if !confirmTOTPReplace(w, u, in.Password) {
+		return
+	}
+	codes, err := enableTOTP(u.Name, in.Code)
 	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	log.Printf("[auth] %s enabled two-factor login", u.Name)
+	_ = json.NewEncoder(w).Encode(struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{codes})
+}
+
+// confirmTOTPReplace asks for the password before an active second factor is
+// replaced, so a stolen session cannot move it to another device.
+func confirmTOTPReplace(w http.ResponseWriter, u panelUser, password string) bool {
+	if u.TOTPSecret == "" {
+		return true
+	}
+	if _, ok := authenticate(u.Name, password); !ok {
+		http.Error(w, errWrongPassword.Error(), 403)
+		return false
+	}
+	return true
+}
+
+func handleTOTPDisable(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	var in struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, "invalid body", 400)
+		return
+	}
+	u, _ := sessionUser(r)
+	if _, ok := authenticate(u.Name, in.Password); !ok {
+		http.Error(w, errWrongPassword.Error(), 403)
+		return
+	}
+	if err := disableTOTP(u.Name); err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
+	log.Printf("[auth] %s disabled two-factor login", u.Name)
+	w.WriteHeader(204)
+}
 
-	payload := struct {
-		UpdatedAt string         `json:"updated_at"`
-		Items     []XUICandidate `json:"items"`
-	}{UpdatedAt: time.Now().UTC().Format(time.RFC3339), Items: items}
+// handleUsers lists accounts (GET) or creates/updates one (POST).
+func handleUsers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		type item struct {
+			Name    string    `json:"name"`
+			Role    string    `json:"role"`
+			Created time.Time `json:"created"`
+			TOTP    bool      `json:"totp"`
+		}
+		usersMu.Lock()
+		out := make([]item, 0, len(users))
+		for _, u := range users {
+			out = append(out, item{u.Name, u.Role, u.Created, u.TOTPSecret != ""})
+		}
+		usersMu.Unlock()
+		_ = json.NewEncoder(w).Encode(struct {
+			Items []item `json:"items"`
+		}{out})
+	case http.MethodPost:
+		var in struct {
+			Name     string `json:"name"`
+			Role     string `json:"role"`
+			Password string `json:"password"`
+			// turns off a user's two-factor login, e.g. after losing the device
+			ResetTOTP bool `json:"reset_totp"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			http.Error(w, "invalid body", 400)
+			return
+		}
+		in.Name = strings.TrimSpace(in.Name)
+		if err := setUser(in.Name, in.Role, in.Password); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if in.ResetTOTP {
+			if err := disableTOTP(in.Name); err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+		}
+		if in.Password != "" {
+			// a reset password ends the user's sessions, except the caller's own
+			c, _ := r.Cookie("sni_sess")
+			sessions.revokeUser(in.Name, c.Value)
+		}
+		log.Printf("[auth] %s updated user %s (role %q, password changed: %v, 2fa reset: %v)", sessionAuthor(r), in.Name, in.Role, in.Password != "", in.ResetTOTP)
+		w.WriteHeader(204)
+	default:
+		http.Error(w, "method not allowed", 405)
+	}
+}
 
-	if b, _ := json.MarshalIndent(payload, "", "  "); len(b) > 0 {
-		_ = writeAtomic(cachePath, b, 0644)
+// handleLockouts lists login failure counters (GET) or clears one, or all
+// without ?key= (DELETE).
+func handleLockouts(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		_ = json.NewEncoder(w).Encode(struct {
+			Items []loginFailures `json:"items"`
+		}{lockouts.list()})
+	case http.MethodDelete:
+		key := r.URL.Query().Get("key")
+		if key == "" {
+			lockouts.clearAll()
+		} else {
+			lockouts.clear(key)
+		}
+		log.Printf("[auth] %s cleared login lockouts %q", sessionAuthor(r), key)
+		w.WriteHeader(204)
+	default:
+		http.Error(w, "method not allowed", 405)
 	}
+}
 
+// handleSessions lists the caller's active sessions, or everyone's for an
+// admin with ?all=1.
+func handleSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	u, _ := sessionUser(r)
+	who := u.Name
+	if r.URL.Query().Get("all") == "1" && hasRole(u.Role, roleAdmin) {
+		who = ""
+	}
+	cur := ""
+	if c, _ := r.Cookie("sni_sess"); c != nil {
+		cur = hashToken(c.Value)
+	}
+	type item struct {
+		session
+		Current bool `json:"current"`
+	}
+	out := []item{}
+	for _, ss := range sessions.list(who) {
+		out = append(out, item{ss, ss.ID == cur})
+	}
 	_ = json.NewEncoder(w).Encode(struct {
-		Items []XUICandidate `json:"items"`
-	}{Items: items})
+		Items []item `json:"items"`
+	}{out})
 }
 
-func handleXUIApply(w http.ResponseWriter, r *http.Request) {
-	var in struct{ IDs []int `json:"ids"` }
-	_ = json.NewDecoder(r.Body).Decode(&in)
-	idset := map[int]bool{}
-	for _, id := range in.IDs {
-		idset[id] = true
+// makeSessionHandler revokes one session (DELETE /api/sessions/<id>; own
+// sessions, or any for an admin) or all of the caller's others (POST
+// /api/sessions/others).
+func makeSessionHandler(base string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, _ := sessionUser(r)
+		c, _ := r.Cookie("sni_sess")
+		id := strings.TrimPrefix(r.URL.Path, base+"/api/sessions/")
+		switch {
+		case id == "others" && r.Method == http.MethodPost:
+			sessions.revokeUser(u.Name, c.Value)
+			log.Printf("[auth] %s ended their other sessions", u.Name)
+		case r.Method == http.MethodDelete:
+			ss, ok := sessions.get(id)
+			if !ok || ss.User != u.Name && !hasRole(u.Role, roleAdmin) {
+				http.Error(w, "no such session", 404)
+				return
+			}
+			sessions.revokeID(id)
+			log.Printf("[auth] %s ended a session of %s (%s)", u.Name, ss.User, ss.IP)
+		default:
+			http.Error(w, "method not allowed", 405)
+			return
+		}
+		w.WriteHeader(204)
+	}
+}
+
+func handleSessionSettings(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		configMutex.Lock()
+		cfg, err := loadConfig()
+		configMutex.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(struct {
+			TTL         string `json:"ttl"`
+			IdleTimeout string `json:"idle_timeout"`
+		}{cfg.SessionTTL, cfg.SessionIdleTimeout})
+	case http.MethodPost:
+		var in struct {
+			TTL         string `json:"ttl"`
+			IdleTimeout string `json:"idle_timeout"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			http.Error(w, "invalid body", 400)
+			return
+		}
+		in.TTL, in.IdleTimeout = strings.TrimSpace(in.TTL), strings.TrimSpace(in.IdleTimeout)
+		if err := validateSessionSettings(in.TTL, in.IdleTimeout); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		configMutex.Lock()
+		cfg, err := loadConfig()
+		if err != nil {
+			configMutex.Unlock()
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		cfg.SessionTTL, cfg.SessionIdleTimeout = in.TTL, in.IdleTimeout
+		if err := saveConfig(cfg, sessionAuthor(r), fmt.Sprintf("set session ttl %q, idle timeout %q", in.TTL, in.IdleTimeout)); err != nil {
+			configMutex.Unlock()
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		configMutex.Unlock()
+		// the TTL applies to new logins; the idle timeout to all sessions
+		_, idle := sessionSettings(cfg)
+		sessions.setIdle(idle)
+		w.WriteHeader(204)
+	default:
+		http.Error(w, "method not allowed", 405)
+	}
+}
+
+func makeDeleteUserHandler(base string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", 405)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, base+"/api/users/")
+		if err := deleteUser(name); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		sessions.revokeUser(name, "")
+		log.Printf("[auth] %s deleted user %s", sessionAuthor(r), name)
+		w.WriteHeader(204)
+	}
+}
+
+// requestSource resolves the ?source= and ?path= query parameters, defaulting
+// to x-ui at its usual database path. Any other path is read as root, so it
+// takes an operator. On failure the error has been written to w.
+func requestSource(w http.ResponseWriter, r *http.Request) (inboundSource, string, bool) {
+	src, err := findInboundSource(strings.TrimSpace(r.URL.Query().Get("source")))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return nil, "", false
+	}
+	path := strings.TrimSpace(r.URL.Query().Get("path"))
+	if path == "" {
+		path = src.DefaultPath()
+	}
+	path = filepath.Clean(path)
+	if path != filepath.Clean(src.DefaultPath()) && !requireRole(w, r, roleOperator) {
+		return nil, "", false
+	}
+	return src, path, true
+}
+
+func handleXUIStatus(w http.ResponseWriter, r *http.Request) {
+	src, path, ok := requestSource(w, r)
+	if !ok {
+		return
+	}
+	type sourceInfo struct {
+		Name        string `json:"name"`
+		DefaultPath string `json:"default_path"`
+		Present     bool   `json:"present"`
+	}
+	out := struct {
+		Source  string       `json:"source"`
+		Present bool         `json:"present"`
+		Path    string       `json:"path"`
+		Sources []sourceInfo `json:"sources"`
+	}{Source: src.Name(), Present: sourcePresent(path), Path: path}
+	for _, s := range inboundSources {
+		out.Sources = append(out.Sources, sourceInfo{s.Name(), s.DefaultPath(), sourcePresent(s.DefaultPath())})
+	}
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+func handleXUIScan(w http.ResponseWriter, r *http.Request) {
+	src, path, ok := requestSource(w, r)
+	if !ok {
+		return
 	}
+	// the snapshot is what apply and prune work from, so it is only replaced
+	// by a scan that succeeded; viewers only get to look
+	u, _ := sessionUser(r)
+	persist := hasRole(u.Role, roleOperator)
 
-	items, err := scanXUI()
+	// taken before scanning so a write during the scan marks it stale
+	sig := pathSignature(path)
+	items, err := scanSource(src, path)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
+	// disabled inbounds are only listed on request (?all=1)
+	if r.URL.Query().Get("all") != "1" {
+		items = enabledCandidates(items)
+	}
 
 	configMutex.Lock()
 	cfg, err := loadConfig()
+	configMutex.Unlock()
 	if err != nil {
-		configMutex.Unlock()
 		http.Error(w, err.Error(), 500)
 		return
 	}
-	applyCount := 0
+	annotateCandidates(&cfg, items)
 
-	for _, it := range items {
-		if len(idset) > 0 && !idset[it.ID] {
-			continue
-		}
-		if it.Port <= 0 || it.Port > 65535 {
-			continue
-		}
-		up := "127.0.0.1:" + strconv.Itoa(it.Port)
+	payload := xuiScanSnapshot{UpdatedAt: time.Now().UTC().Format(time.RFC3339Nano), Source: src.Name(), Path: path, DBSignature: sig, Items: items}
+	if b, _ := json.MarshalIndent(payload, "", "  "); persist && len(b) > 0 {
+		_ = writeAtomic(cachePath, b, 0644)
+	}
 
-		if it.Type == "tls" && it.SNI != "" {
-			found := false
-			for i := range cfg.Mappings {
-				if strings.EqualFold(cfg.Mappings[i].SNI, it.SNI) {
-					cfg.Mappings[i].Upstream = up
-					found = true
-					break
-				}
-			}
-			if !found {
-				cfg.Mappings = append(cfg.Mappings, Mapping{SNI: it.SNI, Upstream: up})
-			}
-			applyCount++
-		} else if it.Type == "http" && it.Host != "" {
-			cfg.HTTPEnabled = true
-			hostFound := false
-			for i := range cfg.HTTPHosts {
-				if strings.EqualFold(cfg.HTTPHosts[i].Host, it.Host) {
-					hostFound = true
-					replaced := false
-					for j := range cfg.HTTPHosts[i].Paths {
-						if cfg.HTTPHosts[i].Paths[j].PathPrefix == it.Path {
-							cfg.HTTPHosts[i].Paths[j].Upstream = up
-							replaced = true
-							break
-						}
-					}
-					if !replaced {
-						cfg.HTTPHosts[i].Paths = append(cfg.HTTPHosts[i].Paths, HTTPPath{PathPrefix: it.Path, Upstream: up})
-					}
-					break
-				}
-			}
-			if !hostFound {
-				cfg.HTTPHosts = append(cfg.HTTPHosts, HTTPHost{Host: it.Host, Paths: []HTTPPath{{PathPrefix: it.Path, Upstream: up}}})
-			}
-			applyCount++
+	_ = json.NewEncoder(w).Encode(struct {
+		UpdatedAt string         `json:"updated_at"`
+		Source    string         `json:"source"`
+		Path      string         `json:"path"`
+		Items     []XUICandidate `json:"items"`
+	}{UpdatedAt: payload.UpdatedAt, Source: payload.Source, Path: path, Items: items})
+}
+
+// handleXUIApply applies candidates from the scan the client is looking at.
+// The request names that scan by its updated_at (and optionally source and
+// path) and is refused with 409 when a newer scan replaced it or the source
+// changed since. Without ids every enabled candidate is applied.
+func handleXUIApply(w http.ResponseWriter, r *http.Request) {
+	var in struct {
+		IDs       []string `json:"ids"`
+		UpdatedAt string   `json:"updated_at"`
+		Source    string   `json:"source"`
+		Path      string   `json:"path"`
+		// overwrite routes that point elsewhere instead of refusing
+		Force bool `json:"force"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil || in.UpdatedAt == "" {
+		http.Error(w, "invalid body: ids and updated_at of the scan required", 400)
+		return
+	}
+	snap, err := loadScanSnapshot()
+	if err != nil || snap.UpdatedAt == "" {
+		http.Error(w, "no scan to apply from, scan first", 409)
+		return
+	}
+	if snap.UpdatedAt != in.UpdatedAt ||
+		in.Source != "" && in.Source != snap.Source ||
+		in.Path != "" && filepath.Clean(in.Path) != snap.Path {
+		http.Error(w, "scan results were replaced by a newer scan, rescan and retry", 409)
+		return
+	}
+	if pathSignature(snap.Path) != snap.DBSignature {
+		http.Error(w, snap.Source+" config changed since the scan, rescan and retry", 409)
+		return
+	}
+
+	known := map[string]bool{}
+	for _, it := range snap.Items {
+		known[it.ID] = true
+	}
+	idset := map[string]bool{}
+	for _, id := range in.IDs {
+		if !known[id] {
+			http.Error(w, "candidate "+id+" is not in the scan, rescan and retry", 409)
+			return
 		}
+		idset[id] = true
 	}
 
-	if err := saveConfig(cfg); err != nil {
+	configMutex.Lock()
+	cfg, err := loadConfig()
+	if err != nil {
 		configMutex.Unlock()
 		http.Error(w, err.Error(), 500)
 		return
 	}
-	configMutex.Unlock()
-
-	if applyCount == 0 {
+	// statuses are recomputed: the config may have changed since the scan
+	var selected []XUICandidate
+	var conflicts, overlaps []string
+	for _, it := range snap.Items {
+		if len(idset) > 0 && !idset[it.ID] || len(idset) == 0 && it.Disabled {
+			continue
+		}
+		annotateCandidate(&cfg, &it)
+		switch {
+		case it.Overlap != "":
+			overlaps = append(overlaps, fmt.Sprintf("%s overlaps %s", it.SNI, it.Overlap))
+		case it.Status == candidateConflict:
+			conflicts = append(conflicts, fmt.Sprintf("%s%s%s -> %s", it.SNI, it.Host, it.Path, it.Existing))
+		}
+		selected = append(selected, it)
+	}
+	if len(overlaps) > 0 {
+		configMutex.Unlock()
+		http.Error(w, "nginx cannot tell these names apart from existing ones: "+strings.Join(overlaps, ", "), 409)
+		return
+	}
+	if len(conflicts) > 0 && !in.Force {
+		configMutex.Unlock()
+		http.Error(w, "already routed elsewhere (set force to overwrite): "+strings.Join(conflicts, ", "), 409)
+		return
+	}
+
+	applyCount, identical := 0, 0
+	for _, it := range selected {
+		if it.Status == candidateIdentical {
+			identical++
+			continue
+		}
+		if applyCandidate(&cfg, it) {
+			applyCount++
+		}
+	}
+	if applyCount == 0 {
+		configMutex.Unlock()
+		if identical > 0 {
+			w.WriteHeader(204) // everything selected is already in place
+			return
+		}
 		http.Error(w, "no applicable entries found", 400)
 		return
 	}
+	if err := saveConfig(cfg, sessionAuthor(r), fmt.Sprintf("x-ui apply (%d entries)", applyCount)); err != nil {
+		configMutex.Unlock()
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	configMutex.Unlock()
+
+	if err := applyAndReload(); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+func handleListRevisions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	configMutex.Lock()
+	revs, err := listRevisions()
+	configMutex.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(struct {
+		Items []ConfigRevision `json:"items"`
+	}{Items: revs})
+}
+
+// keepAdminSettings copies the settings only admins may change from cur into
+// cfg, so restoring a revision cannot change them for an operator.
+func keepAdminSettings(cfg *Config, cur Config) {
+	cfg.IncludeMode, cfg.XUISync = cur.IncludeMode, cur.XUISync
+	cfg.SessionTTL, cfg.SessionIdleTimeout = cur.SessionTTL, cur.SessionIdleTimeout
+}
+
+// makeRevisionHandler serves
+//
+//	GET  .../revisions/{id}
+//	GET  .../revisions/{id}/diff?against=current|prev|{id}
+//	POST .../revisions/{id}/restore
+func makeRevisionHandler(base string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		prefix := base + "/api/config/revisions/"
+		if !strings.HasPrefix(r.URL.Path, prefix) {
+			http.Error(w, "bad path", 400)
+			return
+		}
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, prefix), "/", 2)
+		id, err := strconv.Atoi(parts[0])
+		if err != nil || id <= 0 {
+			http.Error(w, "bad revision id", 400)
+			return
+		}
+		action := ""
+		if len(parts) == 2 {
+			action = parts[1]
+		}
+
+		switch {
+		case action == "" && r.Method == http.MethodGet:
+			configMutex.Lock()
+			rev, err := loadRevision(id)
+			configMutex.Unlock()
+			if err != nil {
+				http.Error(w, err.Error(), 404)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(rev)
+
+		case action == "diff" && r.Method == http.MethodGet:
+			configMutex.Lock()
+			defer configMutex.Unlock()
+			rev, err := loadRevision(id)
+			if err != nil {
+				http.Error(w, err.Error(), 404)
+				return
+			}
+			var from Config
+			fromName := "current"
+			switch against := r.URL.Query().Get("against"); against {
+			case "", "current":
+				if from, err = loadConfig(); err != nil {
+					http.Error(w, err.Error(), 500)
+					return
+				}
+			case "prev":
+				fromName = "(empty)"
+				ids, _ := revisionIDs()
+				for i := len(ids) - 1; i >= 0; i-- {
+					if ids[i] < id {
+						prev, err := loadRevision(ids[i])
+						if err != nil {
+							http.Error(w, err.Error(), 500)
+							return
+						}
+						from, fromName = *prev.Config, fmt.Sprintf("revision %d", ids[i])
+						break
+					}
+				}
+			default:
+				aid, err := strconv.Atoi(against)
+				if err != nil {
+					http.Error(w, "bad against", 400)
+					return
+				}
+				other, err := loadRevision(aid)
+				if err != nil {
+					http.Error(w, err.Error(), 404)
+					return
+				}
+				from, fromName = *other.Config, fmt.Sprintf("revision %d", aid)
+			}
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			_, _ = w.Write([]byte(configDiff(fromName, fmt.Sprintf("revision %d", id), from, *rev.Config)))
+
+		case action == "restore" && r.Method == http.MethodPost:
+			if !requireRole(w, r, roleOperator) {
+				return
+			}
+			configMutex.Lock()
+			rev, err := loadRevision(id)
+			if err != nil {
+				configMutex.Unlock()
+				http.Error(w, err.Error(), 404)
+				return
+			}
+			cur, err := loadConfig()
+			if err != nil {
+				configMutex.Unlock()
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			cfg := *rev.Config
+			// the running server is bound to the current admin path
+			cfg.AdminPath = cur.AdminPath
+			if u, _ := sessionUser(r); !hasRole(u.Role, roleAdmin) {
+				keepAdminSettings(&cfg, cur)
+			}
+			if err := saveConfig(cfg, sessionAuthor(r), fmt.Sprintf("restore revision %d", id)); err != nil {
+				configMutex.Unlock()
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			configMutex.Unlock()
+			_, idle := sessionSettings(cfg)
+			sessions.setIdle(idle)
+			if err := applyAndReload(); err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			w.WriteHeader(204)
+
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	}
+}
+
+// handlePreview renders either a full proposed config or the current config
+// with a single mapping/route change applied, without saving or reloading.
+func handlePreview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	var in struct {
+		Config    *Config         `json:"config"`
+		Mapping   *Mapping        `json:"mapping"`
+		Listener  int             `json:"listener"`
+		HTTPRoute *httpRouteInput `json:"http_route"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, "invalid body", 400)
+		return
+	}
+
+	var cfg Config
+	if in.Config != nil {
+		cfg = *in.Config
+	} else {
+		configMutex.Lock()
+		cur, err := loadConfig()
+		configMutex.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		cfg = cur
+	}
+	if in.Mapping != nil {
+		if err := normalizeMapping(in.Mapping); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		ms, err := streamMappings(&cfg, in.Listener)
+		if err != nil {
+			http.Error(w, err.Error(), 404)
+			return
+		}
+		upsertMapping(ms, *in.Mapping)
+	}
+	if in.HTTPRoute != nil {
+		if err := in.HTTPRoute.normalize(); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		upsertHTTPRoute(&cfg, *in.HTTPRoute)
+	}
+
+	p, err := previewNginxConf(cfg)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(p)
+}
+
+func handleSetIncludeMode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	var in struct {
+		Enabled bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, "invalid body", 400)
+		return
+	}
+	configMutex.Lock()
+	cfg, err := loadConfig()
+	if err != nil {
+		configMutex.Unlock()
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	cfg.IncludeMode = in.Enabled
+	if err := saveConfig(cfg, sessionAuthor(r), fmt.Sprintf("set include mode %v", in.Enabled)); err != nil {
+		configMutex.Unlock()
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	configMutex.Unlock()
+	if err := applyAndReload(); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// handleUpsertListener adds or updates an extra stream listener by port.
+// Mappings of an existing listener are kept.
+func handleUpsertListener(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	var l StreamListener
+	if err := json.NewDecoder(r.Body).Decode(&l); err != nil {
+		http.Error(w, "invalid body", 400)
+		return
+	}
+	if err := normalizeListener(&l); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	configMutex.Lock()
+	cfg, err := loadConfig()
+	if err != nil {
+		configMutex.Unlock()
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if l.Port == 443 && cfg.ListenPort443 {
+		configMutex.Unlock()
+		http.Error(w, "port 443 is used by the built-in listener; disable it first", 409)
+		return
+	}
+	found := false
+	for i := range cfg.StreamListeners {
+		if cfg.StreamListeners[i].Port == l.Port {
+			l.Mappings = cfg.StreamListeners[i].Mappings
+			cfg.StreamListeners[i] = l
+			found = true
+			break
+		}
+	}
+	if !found {
+		l.Mappings = []Mapping{}
+		cfg.StreamListeners = append(cfg.StreamListeners, l)
+	}
+	if err := saveConfig(cfg, sessionAuthor(r), fmt.Sprintf("set stream listener %d", l.Port)); err != nil {
+		configMutex.Unlock()
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	configMutex.Unlock()
+	if err := applyAndReload(); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+func makeDeleteListenerHandler(base string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", 405)
+			return
+		}
+		port, err := listenerPort(strings.TrimPrefix(r.URL.Path, base+"/api/stream/listener/"))
+		if err != nil || port == 0 {
+			http.Error(w, "bad port", 400)
+			return
+		}
+		configMutex.Lock()
+		cfg, err := loadConfig()
+		if err != nil {
+			configMutex.Unlock()
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		var out []StreamListener
+		for _, l := range cfg.StreamListeners {
+			if l.Port != port {
+				out = append(out, l)
+			}
+		}
+		cfg.StreamListeners = out
+		if err := saveConfig(cfg, sessionAuthor(r), fmt.Sprintf("delete stream listener %d", port)); err != nil {
+			configMutex.Unlock()
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		configMutex.Unlock()
+		if err := applyAndReload(); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.WriteHeader(204)
+	}
+}
+
+func handleSetListen443(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	var in struct {
+		Enabled bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, "invalid body", 400)
+		return
+	}
+	configMutex.Lock()
+	cfg, err := loadConfig()
+	if err != nil {
+		configMutex.Unlock()
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if in.Enabled {
+		for _, l := range cfg.StreamListeners {
+			if l.Port == 443 {
+				configMutex.Unlock()
+				http.Error(w, "an extra stream listener already uses port 443", 409)
+				return
+			}
+		}
+	}
+	cfg.ListenPort443 = in.Enabled
+	if err := saveConfig(cfg, sessionAuthor(r), fmt.Sprintf("set listen 443 %v", in.Enabled)); err != nil {
+		configMutex.Unlock()
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	configMutex.Unlock()
+	if err := applyAndReload(); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// handleXUISync reports (GET) or sets (POST {"mode"}) the x-ui auto-sync
+// mode along with the last applied scan and any queued changes.
+func handleXUISync(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		configMutex.Lock()
+		cfg, err := loadConfig()
+		configMutex.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		xuiSyncMu.Lock()
+		st, err := loadXUISyncState()
+		xuiSyncMu.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(struct {
+			Mode string `json:"mode"`
+			xuiSyncState
+		}{cfg.XUISync, st})
+	case http.MethodPost:
+		if !requireRole(w, r, roleAdmin) {
+			return
+		}
+		var in struct {
+			Mode string `json:"mode"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			http.Error(w, "invalid body", 400)
+			return
+		}
+		in.Mode = strings.TrimSpace(in.Mode)
+		if err := validateXUISync(in.Mode); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		configMutex.Lock()
+		cfg, err := loadConfig()
+		if err != nil {
+			configMutex.Unlock()
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		cfg.XUISync = in.Mode
+		if err := saveConfig(cfg, sessionAuthor(r), fmt.Sprintf("set x-ui sync mode %q", in.Mode)); err != nil {
+			configMutex.Unlock()
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		configMutex.Unlock()
+		go func() {
+			if err := syncXUI(); err != nil {
+				log.Printf("[xui/sync] %v", err)
+			}
+		}()
+		w.WriteHeader(204)
+	default:
+		http.Error(w, "method not allowed", 405)
+	}
+}
+
+// handleXUISyncApprove applies the queued x-ui change set.
+func handleXUISyncApprove(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	xuiSyncMu.Lock()
+	defer xuiSyncMu.Unlock()
+	st, err := loadXUISyncState()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if st.Pending == nil {
+		http.Error(w, "no pending changes", 409)
+		return
+	}
+	cerr := commitXUIChanges(&st, *st.Pending, sessionAuthor(r))
+	if err := saveXUISyncState(st); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if cerr != nil {
+		http.Error(w, cerr.Error(), 500)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// handleXUISyncDiscard drops the queued change set and takes its scan as the
+// new baseline, so the same changes are not proposed again.
+func handleXUISyncDiscard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	xuiSyncMu.Lock()
+	defer xuiSyncMu.Unlock()
+	st, err := loadXUISyncState()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if st.Pending != nil {
+		st.Applied = st.Pending.Snapshot
+		st.Pending = nil
+	}
+	if err := saveXUISyncState(st); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// handleXUIPrune finds routes imported from a source whose inbound is gone.
+// GET returns them with an nginx preview of the pruned config; POST removes
+// them.
+func handleXUIPrune(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	src, path, ok := requestSource(w, r)
+	if !ok {
+		return
+	}
+	if !sourcePresent(path) {
+		// an unreadable source would make every one of its routes look orphaned
+		http.Error(w, path+" not found", 404)
+		return
+	}
+	items, err := scanSource(src, path)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	configMutex.Lock()
+	cfg, err := loadConfig()
+	if err != nil {
+		configMutex.Unlock()
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	orphans, disabled := pruneOrphans(&cfg, src.Name(), items)
+
+	if r.Method == http.MethodGet {
+		configMutex.Unlock()
+		out := struct {
+			Routes   []orphanRoute `json:"routes"`
+			Disabled []orphanRoute `json:"disabled,omitempty"` // kept
+			Preview  *NginxPreview `json:"preview,omitempty"`
+		}{Routes: orphans, Disabled: disabled}
+		if len(orphans) > 0 {
+			p, err := previewNginxConf(cfg)
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			out.Preview = &p
+		}
+		_ = json.NewEncoder(w).Encode(out)
+		return
+	}
+
+	if len(orphans) == 0 {
+		configMutex.Unlock()
+		http.Error(w, "no orphaned "+src.Name()+" routes", 400)
+		return
+	}
+	if err := saveConfig(cfg, sessionAuthor(r), fmt.Sprintf("prune %d orphaned %s routes", len(orphans), src.Name())); err != nil {
+		configMutex.Unlock()
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	configMutex.Unlock()
 	if err := applyAndReload(); err != nil {
 		http.Error(w, err.Error(), 500)
 		return
@@ -55,6 +55,14 @@ func loadConfig() (Config, error) {
 	return c, nil
 }
 
-func saveConfig(c Config) error {
-	return writeAtomic(configPath, mustJSON(c), 0644)
+// saveConfig writes config.json and records it as a new revision attributed
+// to author. Caller must hold configMutex.
+func saveConfig(c Config, author, reason string) error {
+	if err := writeAtomic(configPath, mustJSON(c), 0644); err != nil {
+		return err
+	}
+	if err := recordRevision(c, author, reason); err != nil {
+		log.Printf("config revision not recorded: %v", err)
+	}
+	return nil
 }
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Scan candidate status against the current config.
+const (
+	candidateNew       = "new"
+	candidateIdentical = "identical"
+	candidateChanged   = "changed" // the route this inbound created, now different
+	candidateConflict  = "conflict"
+)
+
+// annotateCandidate sets it.Status and, when a route already exists for
+// its SNI or host+path, what that route points at. Only a route that matches
+// in upstream, PROXY protocol and transport too is identical. A candidate whose SNI
+// nginx could not hash next to an existing key is a conflict with Overlap
+// set; forcing cannot apply it.
+func annotateCandidate(cfg *Config, it *XUICandidate) {
+	it.Status, it.Existing, it.ExistingSource, it.Overlap = candidateNew, "", nil, ""
+	up := candidateUpstream(*it)
+
+	if it.Type == "tls" {
+		for _, m := range cfg.Mappings {
+			if !strings.EqualFold(m.SNI, it.SNI) || m.ALPN != alpnAny {
+				continue
+			}
+			it.Existing, it.ExistingSource = m.Upstream, m.Source
+			if m.isGroup() {
+				it.Existing = fmt.Sprintf("group of %d", len(m.Servers))
+			}
+			it.Status = candidateConflict
+			if !m.isGroup() && m.Upstream == up && m.ProxyProtocol == it.ProxyProtocol {
+				it.Status = candidateIdentical
+			}
+			markChanged(it)
+			return
+		}
+		if other, ok := sniConflict(cfg.Mappings, it.SNI); ok {
+			it.Status, it.Overlap = candidateConflict, other
+		}
+		return
+	}
+
+	for _, h := range cfg.HTTPHosts {
+		if !strings.EqualFold(h.Host, it.Host) {
+			continue
+		}
+		for _, p := range h.Paths {
+			if p.PathPrefix != it.Path {
+				continue
+			}
+			it.Existing, it.ExistingSource = p.Upstream, p.Source
+			if t := p.transport(); t != it.Transport {
+				it.Existing += " (" + transportName(t) + ")"
+			}
+			it.Status = candidateConflict
+			if p.Upstream == up && p.transport() == it.Transport {
+				it.Status = candidateIdentical
+			}
+			markChanged(it)
+			return
+		}
+	}
+}
+
+func annotateCandidates(cfg *Config, items []XUICandidate) {
+	for i := range items {
+		annotateCandidate(cfg, &items[i])
+	}
+}
+
+// markChanged turns a conflict with the route its own inbound created into
+// an update of that route.
+func markChanged(it *XUICandidate) {
+	if it.Status == candidateConflict && it.ExistingSource.is(*it) {
+		it.Status = candidateChanged
+	}
+}
+
+// transportName labels a transport for messages; the empty one is plain HTTP.
+func transportName(t string) string {
+	if t == transportHTTP {
+		return "http"
+	}
+	return t
+}
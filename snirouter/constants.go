@@ -5,9 +5,35 @@ import "sync"
 var (
 	configPath = "/etc/snirouter/config.json"
 	credsPath  = "/etc/snirouter/ADMIN.txt"
-	cachePath  = "/etc/snirouter/cache.json"
-	nginxConf  = "/etc/nginx/nginx.conf"
-	xuiDBPath  = "/etc/x-ui/x-ui.db"
+	usersPath  = "/etc/snirouter/users.json"
+	// a generated first admin password, root-only until install.sh shows and
+	// deletes it
+	initialPassPath = "/etc/snirouter/initial-password.txt"
+	// logged-in sessions, by token hash, so restarts keep everyone logged in
+	sessionsPath = "/etc/snirouter/sessions.json"
+	cachePath    = "/etc/snirouter/cache.json"
+	nginxConf    = "/etc/nginx/nginx.conf"
+	xuiDBPath    = "/etc/x-ui/x-ui.db"
+
+	// include mode: snirouter only owns these, nginx.conf just includes them
+	nginxIncludeDir = "/etc/nginx/snirouter"
+	nginxOrigBackup = "/etc/nginx/nginx.conf.snirouter-orig"
+
+	// local stream relays used when some backend wants PROXY protocol
+	plainRelaySock = "/run/snirouter-plain.sock"
+	ppRelaySock    = "/run/snirouter-pp.sock"
+	// closes rejected connections right after the ClientHello
+	rejectSock = "/run/snirouter-reject.sock"
+
+	// last config that passed nginx -t and reloaded successfully
+	goodConfigPath = "/etc/snirouter/config.good.json"
+	goodNginxPath  = "/etc/snirouter/nginx.good.json"
+
+	// x-ui auto-sync: what was last applied and any change set awaiting approval
+	xuiSyncPath = "/etc/snirouter/xui-sync.json"
+
+	revisionsDir = "/etc/snirouter/revisions"
+	maxRevisions = 200
 
 	configMutex sync.Mutex
 )
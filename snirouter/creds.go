@@ -3,41 +3,45 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 func parseAdminFile(b []byte) (adminCred, bool) {
 	txt := string(b)
 
-	// 1) JSON: {"user":"...","pass":"..."}
+	// 1) JSON: {"user":"...","hash":"..."} or, from older versions, "pass"
 	var j map[string]string
 	if json.Unmarshal(b, &j) == nil {
 		u := strings.TrimSpace(j["user"])
+		h := strings.TrimSpace(j["hash"])
 		p := strings.TrimSpace(j["pass"])
-		if u != "" && p != "" {
-			return adminCred{User: u, Pass: p}, true
+		if u != "" && (h != "" || p != "") {
+			return adminCred{User: u, Hash: h, Pass: p}, true
 		}
 	}
 
-	// 2) Lines: "Username: X\nPassword: Y"
-	var u, p string
+	// 2) Lines: "Username: X\nPassword-Hash: H" (or "Password: Y")
+	var u, h, p string
 	for _, ln := range strings.Split(txt, "\n") {
 		ln = strings.TrimSpace(ln)
 		low := strings.ToLower(ln)
-		if strings.HasPrefix(low, "username:") {
-			u = strings.TrimSpace(strings.TrimPrefix(ln, "Username:"))
-			u = strings.TrimSpace(strings.TrimPrefix(u, "username:"))
-		}
-		if strings.HasPrefix(low, "password:") {
-			p = strings.TrimSpace(strings.TrimPrefix(ln, "Password:"))
-			p = strings.TrimSpace(strings.TrimPrefix(p, "password:"))
+		switch {
+		case strings.HasPrefix(low, "username:"):
+			u = strings.TrimSpace(ln[len("username:"):])
+		case strings.HasPrefix(low, "password-hash:"):
+			h = strings.TrimSpace(ln[len("password-hash:"):])
+		case strings.HasPrefix(low, "password:"):
+			p = strings.TrimSpace(ln[len("password:"):])
 		}
 	}
-	if u != "" && p != "" {
-		return adminCred{User: u, Pass: p}, true
+	if u != "" && (h != "" || p != "") {
+		return adminCred{User: u, Hash: h, Pass: p}, true
 	}
 
 	// 3) Single-line: "user:pass"
@@ -51,10 +55,52 @@ func parseAdminFile(b []byte) (adminCred, bool) {
 	return adminCred{}, false
 }
 
+func hashPassword(pass string) (string, error) {
+	h, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+	return string(h), err
+}
+
+// writeAdminCreds stores cr's hash, keeping the "Panel Path" line of the
+// existing file (main fills in %ADMIN_PATH% on start). Without a hash it
+// points at the user store instead.
+func writeAdminCreds(cr adminCred) error {
+	panel := "Panel Path: /%ADMIN_PATH%"
+	if b, err := os.ReadFile(credsPath); err == nil {
+		for _, ln := range strings.Split(string(b), "\n") {
+			if strings.HasPrefix(strings.ToLower(strings.TrimSpace(ln)), "panel path:") {
+				panel = strings.TrimSpace(ln)
+			}
+		}
+	}
+	content := fmt.Sprintf("%s\nUsername: %s\nPassword-Hash: %s\n", panel, cr.User, cr.Hash)
+	if cr.Hash == "" {
+		content = fmt.Sprintf("%s\nUsername: %s\nAccounts: %s\n", panel, cr.User, usersPath)
+	}
+	if err := os.MkdirAll(filepath.Dir(credsPath), 0700); err != nil {
+		return err
+	}
+	return writeAtomic(credsPath, []byte(content), 0600)
+}
+
+// ensureAdminCreds loads the admin account, hashing a plaintext password left
+// by an older version, or creates one. A generated password is never logged,
+// only left in initialPassPath.
 func ensureAdminCreds() (adminCred, error) {
 	if st, err := os.Stat(credsPath); err == nil && !st.IsDir() {
 		if b, rerr := os.ReadFile(credsPath); rerr == nil {
 			if cr, ok := parseAdminFile(b); ok {
+				if cr.Hash != "" {
+					return cr, nil
+				}
+				h, err := hashPassword(cr.Pass)
+				if err != nil {
+					return adminCred{}, err
+				}
+				cr.Hash, cr.Pass = h, ""
+				if err := writeAdminCreds(cr); err != nil {
+					return adminCred{}, err
+				}
+				log.Printf("[auth] replaced the plaintext password in %s with a bcrypt hash", credsPath)
 				return cr, nil
 			}
 		}
@@ -62,28 +108,18 @@ func ensureAdminCreds() (adminCred, error) {
 		_ = os.Rename(credsPath, credsPath+".broken-"+ts)
 	}
 
-	cr := adminCred{
-		User: "admin-" + randomToken(4),
-		Pass: randomToken(14),
-	}
-	content := []byte(fmt.Sprintf("Panel Path: /%%ADMIN_PATH%%\nUsername: %s\nPassword: %s\n", cr.User, cr.Pass))
-
-	if err := os.MkdirAll(filepath.Dir(credsPath), 0700); err != nil {
+	pass := randomToken(14)
+	h, err := hashPassword(pass)
+	if err != nil {
 		return adminCred{}, err
 	}
-	if err := os.WriteFile(credsPath, content, 0600); err != nil {
+	cr := adminCred{User: "admin-" + randomToken(4), Hash: h}
+	if err := writeAtomic(initialPassPath, []byte(fmt.Sprintf("Username: %s\nPassword: %s\n", cr.User, pass)), 0600); err != nil {
 		return adminCred{}, err
 	}
-	return cr, nil
-}
-
-func readAdminCreds() (adminCred, error) {
-	b, err := os.ReadFile(credsPath)
-	if err != nil {
+	if err := writeAdminCreds(cr); err != nil {
 		return adminCred{}, err
 	}
-	if cr, ok := parseAdminFile(b); ok {
-		return cr, nil
-	}
-	return adminCred{}, fmt.Errorf("invalid %s format", credsPath)
+	log.Printf("[auth] created admin %s, its password is in %s (change it from the panel)", cr.User, initialPassPath)
+	return cr, nil
 }
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func numberedLines(n int) string {
+	var b strings.Builder
+	for i := 1; i <= n; i++ {
+		fmt.Fprintf(&b, "l%d\n", i)
+	}
+	return b.String()
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	base := numberedLines(20)
+	replace := func(s string, pairs ...string) string { return strings.NewReplacer(pairs...).Replace(s) }
+
+	// expected output checked against GNU diff -u
+	tests := []struct {
+		name, a, b, want string
+	}{
+		{"identical", base, base, ""},
+		{"both empty", "", "", ""},
+		{"from empty", "", "a\nb\n", "--- a\n+++ b\n@@ -0,0 +1,2 @@\n+a\n+b\n"},
+		{"to empty", "a\nb\n", "", "--- a\n+++ b\n@@ -1,2 +0,0 @@\n-a\n-b\n"},
+		{"change in the middle", base, replace(base, "l10\n", "X\n"),
+			"--- a\n+++ b\n@@ -7,7 +7,7 @@\n l7\n l8\n l9\n-l10\n+X\n l11\n l12\n l13\n"},
+		{"insert at start", base, "new\n" + base,
+			"--- a\n+++ b\n@@ -1,3 +1,4 @@\n+new\n l1\n l2\n l3\n"},
+		{"delete at end", base, strings.TrimSuffix(base, "l20\n"),
+			"--- a\n+++ b\n@@ -17,4 +17,3 @@\n l17\n l18\n l19\n-l20\n"},
+		{"far apart changes make two hunks", base, replace(base, "l3\n", "X\n", "l18\n", "Y\n"),
+			"--- a\n+++ b\n@@ -1,6 +1,6 @@\n l1\n l2\n-l3\n+X\n l4\n l5\n l6\n" +
+				"@@ -15,6 +15,6 @@\n l15\n l16\n l17\n-l18\n+Y\n l19\n l20\n"},
+		{"changes six lines apart share a hunk", base, replace(base, "l3\n", "X\n", "l10\n", "Y\n"),
+			"--- a\n+++ b\n@@ -1,13 +1,13 @@\n l1\n l2\n-l3\n+X\n l4\n l5\n l6\n l7\n l8\n l9\n-l10\n+Y\n l11\n l12\n l13\n"},
+		{"changes seven lines apart split", base, replace(base, "l3\n", "X\n", "l11\n", "Y\n"),
+			"--- a\n+++ b\n@@ -1,6 +1,6 @@\n l1\n l2\n-l3\n+X\n l4\n l5\n l6\n" +
+				"@@ -8,7 +8,7 @@\n l8\n l9\n l10\n-l11\n+Y\n l12\n l13\n l14\n"},
+	}
+	for _, tt := range tests {
+		if got := unifiedDiff("a", "b", tt.a, tt.b); got != tt.want {
+			t.Errorf("%s:\ngot:\n%s\nwant:\n%s", tt.name, got, tt.want)
+		}
+	}
+}
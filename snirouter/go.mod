@@ -1,3 +1,5 @@
 module github.com.parsaksh/snirouter
 
 go 1.22.12
+
+require golang.org/x/crypto v0.31.0
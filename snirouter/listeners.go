@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// effectiveListeners returns every stream listener to render: the built-in
+// one on 443 (when ListenPort443 is set) followed by the extra ones.
+func effectiveListeners(c Config) []StreamListener {
+	var out []StreamListener
+	if c.ListenPort443 {
+		out = append(out, StreamListener{
+			Port:                 443,
+			IPv4:                 true,
+			IPv6:                 true,
+			ReusePort:            true,
+			DefaultUP:            c.DefaultUP,
+			DefaultProxyProtocol: c.DefaultProxyProtocol,
+			Mappings:             c.Mappings,
+			NoSNIUpstream:        c.NoSNIUpstream,
+			RejectUnknownSNI:     c.RejectUnknownSNI,
+			BlackholeUP:          c.BlackholeUP,
+		})
+	}
+	return append(out, c.StreamListeners...)
+}
+
+func normalizeListener(l *StreamListener) error {
+	l.Bind = strings.TrimSpace(l.Bind)
+	l.DefaultUP = strings.TrimSpace(l.DefaultUP)
+	l.NoSNIUpstream = strings.TrimSpace(l.NoSNIUpstream)
+	l.BlackholeUP = strings.TrimSpace(l.BlackholeUP)
+	if l.Port <= 0 || l.Port > 65535 {
+		return fmt.Errorf("invalid port %d", l.Port)
+	}
+	if l.Bind != "" && net.ParseIP(strings.Trim(l.Bind, "[]")) == nil {
+		return fmt.Errorf("invalid bind address %q", l.Bind)
+	}
+	if l.Bind == "" && !l.IPv4 && !l.IPv6 {
+		return errors.New("listener needs ipv4, ipv6 or a bind address")
+	}
+	if l.DefaultUP == "" && !l.RejectUnknownSNI {
+		return errors.New("default_upstream required")
+	}
+	for _, up := range []string{l.DefaultUP, l.NoSNIUpstream, l.BlackholeUP} {
+		if strings.ContainsAny(up, " ;{}\"") {
+			return fmt.Errorf("invalid upstream %q", up)
+		}
+	}
+	return nil
+}
+
+const noSNIReject = "reject"
+
+// unknownAndNoSNI resolves where unmatched and SNI-less connections of l go.
+// noSNI is "" when they share the unknown-name target.
+func unknownAndNoSNI(l StreamListener, suffix string) (unknown, noSNI string, needReject bool) {
+	reject := l.BlackholeUP
+	if reject == "" {
+		reject = "unix:" + suffixedSock(rejectSock, suffix)
+	}
+	unknown = l.DefaultUP
+	if l.RejectUnknownSNI {
+		unknown = reject
+	}
+	switch l.NoSNIUpstream {
+	case "":
+	case noSNIReject:
+		noSNI = reject
+	default:
+		noSNI = l.NoSNIUpstream
+	}
+	needReject = l.BlackholeUP == "" && (l.RejectUnknownSNI || l.NoSNIUpstream == noSNIReject)
+	return unknown, noSNI, needReject
+}
+
+// listenDirectives renders the listen lines of l.
+func listenDirectives(l StreamListener) []string {
+	opt := ""
+	if l.ReusePort {
+		opt = " reuseport"
+	}
+	port := strconv.Itoa(l.Port)
+	if l.Bind != "" {
+		return []string{"listen " + net.JoinHostPort(strings.Trim(l.Bind, "[]"), port) + opt + ";"}
+	}
+	var out []string
+	if l.IPv4 {
+		out = append(out, "listen "+port+opt+";")
+	}
+	if l.IPv6 {
+		out = append(out, "listen [::]:"+port+opt+";")
+	}
+	return out
+}
+
+// streamMappings returns the mapping list addressed by port. 0, or 443 while
+// the built-in listener is on, means the top-level list.
+func streamMappings(cfg *Config, port int) (*[]Mapping, error) {
+	if port == 0 || (port == 443 && cfg.ListenPort443) {
+		return &cfg.Mappings, nil
+	}
+	for i := range cfg.StreamListeners {
+		if cfg.StreamListeners[i].Port == port {
+			return &cfg.StreamListeners[i].Mappings, nil
+		}
+	}
+	return nil, fmt.Errorf("no stream listener on port %d", port)
+}
+
+// listenerPort reads the optional ?listener= query parameter.
+func listenerPort(q string) (int, error) {
+	if q == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(q)
+	if err != nil || n <= 0 || n > 65535 {
+		return 0, fmt.Errorf("invalid listener %q", q)
+	}
+	return n, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// failures allowed before each further one blocks the IP or user name
+	loginFreeFailures = 3
+	// the block doubles with every failure from loginBackoffBase up to
+	// loginMaxLockout
+	loginBackoffBase = 2 * time.Second
+	loginMaxLockout  = 15 * time.Minute
+	// a key with no failure for this long starts over
+	loginFailureWindow = 24 * time.Hour
+)
+
+type loginFailures struct {
+	Key         string    `json:"key"` // "ip:<addr>" or "user:<name>"
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+type lockoutTracker struct {
+	mu   sync.Mutex
+	data map[string]*loginFailures
+}
+
+var lockouts = &lockoutTracker{data: make(map[string]*loginFailures)}
+
+func ipKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+func userKey(name string) string { return "user:" + name }
+
+// locked returns how much longer any of keys is blocked.
+func (t *lockoutTracker) locked(keys ...string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var wait time.Duration
+	for _, k := range keys {
+		if f, ok := t.data[k]; ok {
+			if d := time.Until(f.LockedUntil); d > wait {
+				wait = d
+			}
+		}
+	}
+	return wait
+}
+
+// fail counts a failed attempt against keys, blocking those past
+// loginFreeFailures for an exponentially growing time.
+func (t *lockoutTracker) fail(keys ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	for k, f := range t.data {
+		if now.Sub(f.LastFailure) > loginFailureWindow {
+			delete(t.data, k)
+		}
+	}
+	for _, k := range keys {
+		f, ok := t.data[k]
+		if !ok {
+			f = &loginFailures{Key: k}
+			t.data[k] = f
+		}
+		f.Failures++
+		f.LastFailure = now
+		if n := f.Failures - loginFreeFailures; n > 0 {
+			d := loginMaxLockout
+			if n < 20 {
+				d = min(loginBackoffBase<<(n-1), loginMaxLockout)
+			}
+			f.LockedUntil = now.Add(d)
+		}
+	}
+}
+
+func (t *lockoutTracker) clear(keys ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, k := range keys {
+		delete(t.data, k)
+	}
+}
+
+func (t *lockoutTracker) clearAll() {
+	t.mu.Lock()
+	t.data = make(map[string]*loginFailures)
+	t.mu.Unlock()
+}
+
+// list returns keys with failures in the current window, blocked ones first.
+func (t *lockoutTracker) list() []loginFailures {
+	t.mu.Lock()
+	out := make([]loginFailures, 0, len(t.data))
+	for _, f := range t.data {
+		if time.Since(f.LastFailure) <= loginFailureWindow {
+			out = append(out, *f)
+		}
+	}
+	t.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].LockedUntil.Equal(out[j].LockedUntil) {
+			return out[i].LockedUntil.After(out[j].LockedUntil)
+		}
+		return out[i].Key < out[j].Key
+	})
+	return out
+}
+
+// logLoginFailure writes the line fail2ban matches, e.g. with
+//
+//	failregex = \[auth\] login failed ip=<HOST> user=
+//
+// Keep the format stable.
+func logLoginFailure(r *http.Request, user, reason string) {
+	log.Printf("[auth] login failed ip=%s user=%q reason=%s", ipKey(r)[len("ip:"):], user, reason)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockoutBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, 0},
+		{loginFreeFailures, 0},
+		{loginFreeFailures + 1, loginBackoffBase},
+		{loginFreeFailures + 2, 2 * loginBackoffBase},
+		{loginFreeFailures + 3, 4 * loginBackoffBase},
+		{loginFreeFailures + 9, 256 * loginBackoffBase},
+		{loginFreeFailures + 10, loginMaxLockout},
+		{loginFreeFailures + 19, loginMaxLockout},
+		{loginFreeFailures + 20, loginMaxLockout},
+		{loginFreeFailures + 100, loginMaxLockout}, // no shift overflow
+	}
+	for _, tt := range tests {
+		lt := &lockoutTracker{data: map[string]*loginFailures{}}
+		for i := 0; i < tt.failures; i++ {
+			lt.fail("ip:192.0.2.1")
+		}
+		got := lt.locked("ip:192.0.2.1")
+		if got > tt.want || got < tt.want-time.Second {
+			t.Errorf("%d failures: locked for %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestLockoutKeys(t *testing.T) {
+	lt := &lockoutTracker{data: map[string]*loginFailures{}}
+	ip, user := "ip:192.0.2.1", userKey("alice")
+	for i := 0; i <= loginFreeFailures; i++ {
+		lt.fail(ip, user)
+	}
+	if lt.locked(ip) == 0 || lt.locked(user) == 0 {
+		t.Fatal("both keys should be locked")
+	}
+	if lt.locked("ip:192.0.2.2", userKey("bob")) != 0 {
+		t.Error("other keys locked too")
+	}
+	if lt.locked("ip:192.0.2.2", user) == 0 {
+		t.Error("the user stays locked from another address")
+	}
+
+	lt.clear(user)
+	if lt.locked(user) != 0 || lt.locked(ip) == 0 {
+		t.Error("clear dropped the wrong key")
+	}
+
+	// a key whose last failure is outside the window starts over
+	lt.data[ip].LastFailure = time.Now().Add(-loginFailureWindow - time.Minute)
+	lt.fail(ip)
+	if f := lt.data[ip]; f.Failures != 1 || lt.locked(ip) != 0 {
+		t.Errorf("after the window: %d failures, locked %v", f.Failures, lt.locked(ip))
+	}
+}
+
+func TestLockoutList(t *testing.T) {
+	lt := &lockoutTracker{data: map[string]*loginFailures{}}
+	lt.fail("ip:192.0.2.9")
+	for i := 0; i <= loginFreeFailures; i++ {
+		lt.fail("ip:192.0.2.1")
+	}
+	lt.fail("ip:192.0.2.5")
+	lt.data["ip:192.0.2.7"] = &loginFailures{Key: "ip:192.0.2.7", Failures: 1, LastFailure: time.Now().Add(-2 * loginFailureWindow)}
+
+	var keys []string
+	for _, f := range lt.list() {
+		keys = append(keys, f.Key)
+	}
+	want := []string{"ip:192.0.2.1", "ip:192.0.2.5", "ip:192.0.2.9"}
+	if len(keys) != len(want) {
+		t.Fatalf("list = %v, want %v", keys, want)
+	}
+	for i := range want {
+		if keys[i] != want[i] {
+			t.Fatalf("list = %v, want %v", keys, want)
+		}
+	}
+
+	lt.clearAll()
+	if len(lt.list()) != 0 {
+		t.Error("clearAll left entries")
+	}
+}
@@ -24,12 +24,17 @@ log.Printf("embed sizes: login=%d, index=%d", len(loginHTML), len(indexHTML))
 	if err != nil {
 		log.Fatal(err)
 	}
+	seedKnownGood(cfg)
 
-
-	cr, err := ensureAdminCreds()
-	if err != nil {
+	if err := ensureUsers(); err != nil {
+		log.Fatal(err)
+	}
+	if err := sessions.load(); err != nil {
 		log.Fatal(err)
 	}
+	_, idle := sessionSettings(cfg)
+	sessions.setIdle(idle)
+	go sessions.sweepLoop()
 	if b, err := os.ReadFile(credsPath); err == nil {
 		nb := strings.ReplaceAll(string(b), "%ADMIN_PATH%", cfg.AdminPath)
 		_ = os.WriteFile(credsPath, []byte(nb), 0600)
@@ -42,7 +47,7 @@ log.Printf("embed sizes: login=%d, index=%d", len(loginHTML), len(indexHTML))
 			http.Error(w, "method not allowed", 405)
 			return
 		}
-		if c, _ := r.Cookie("sni_sess"); c != nil && sessions.valid(c.Value) {
+		if _, ok := sessionUser(r); ok {
 			http.Redirect(w, r, base+"/", http.StatusFound)
 			return
 		}
@@ -65,14 +70,62 @@ log.Printf("embed sizes: login=%d, index=%d", len(loginHTML), len(indexHTML))
 			_ = json.NewDecoder(r.Body).Decode(&in)
 			user, pass = in.Username, in.Password
 		}
-		if ac, err := readAdminCreds(); err == nil && user == ac.User && pass == ac.Pass {
-			tok := sessions.create(24 * time.Hour)
-			setSessionCookie(w, base, tok, 24*time.Hour)
+		// blocked attempts are refused before the password is even checked
+		if lockouts.locked(ipKey(r), userKey(user)) > 0 {
+			logLoginFailure(r, user, "locked")
+			http.Redirect(w, r, base+"/login?err=3", http.StatusSeeOther)
+			return
+		}
+		if u, ok := authenticate(user, pass); ok {
+			if u.TOTPSecret != "" {
+				setChallengeCookie(w, base, challenges.create(u.Name))
+				http.Redirect(w, r, base+"/login?step=2fa", http.StatusSeeOther)
+				return
+			}
+			lockouts.clear(ipKey(r), userKey(u.Name))
+			startSession(w, r, base, u.Name)
 			http.Redirect(w, r, base+"/", http.StatusSeeOther)
 			return
 		}
+		lockouts.fail(ipKey(r), userKey(user))
+		logLoginFailure(r, user, "password")
 		http.Redirect(w, r, base+"/login?err=1", http.StatusSeeOther)
 	})
+	// second login step for accounts with two-factor enabled
+	http.HandleFunc(base+"/login/2fa", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", 405)
+			return
+		}
+		_ = r.ParseForm()
+		c, _ := r.Cookie("sni_2fa")
+		if c == nil {
+			http.Redirect(w, r, base+"/login?err=2", http.StatusSeeOther)
+			return
+		}
+		user, ok := challenges.attempt(c.Value)
+		if !ok {
+			clearChallengeCookie(w, base)
+			http.Redirect(w, r, base+"/login?err=2", http.StatusSeeOther)
+			return
+		}
+		if lockouts.locked(ipKey(r), userKey(user)) > 0 {
+			logLoginFailure(r, user, "locked")
+			http.Redirect(w, r, base+"/login?step=2fa&err=3", http.StatusSeeOther)
+			return
+		}
+		if !checkSecondFactor(user, r.Form.Get("code")) {
+			lockouts.fail(ipKey(r), userKey(user))
+			logLoginFailure(r, user, "2fa")
+			http.Redirect(w, r, base+"/login?step=2fa&err=1", http.StatusSeeOther)
+			return
+		}
+		lockouts.clear(ipKey(r), userKey(user))
+		challenges.done(c.Value)
+		clearChallengeCookie(w, base)
+		startSession(w, r, base, user)
+		http.Redirect(w, r, base+"/", http.StatusSeeOther)
+	})
 	http.HandleFunc(base+"/logout", func(w http.ResponseWriter, r *http.Request) {
 		if c, _ := r.Cookie("sni_sess"); c != nil {
 			sessions.revoke(c.Value)
@@ -80,7 +133,7 @@ log.Printf("embed sizes: login=%d, index=%d", len(loginHTML), len(indexHTML))
 		clearSessionCookie(w, base)
 		http.Redirect(w, r, base+"/login", http.StatusFound)
 	})
-	http.HandleFunc(base+"/", requireSession(base, func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc(base+"/", requireSession(base, roleViewer, func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path != base && r.URL.Path != base+"/" {
 			http.NotFound(w, r)
 			return
@@ -89,35 +142,59 @@ log.Printf("embed sizes: login=%d, index=%d", len(loginHTML), len(indexHTML))
 		w.Write(indexHTML)
 	}))
 
-	http.HandleFunc(base+"/api/config", requireSession(base, handleGetConfig))
-	http.HandleFunc(base+"/api/default", requireSession(base, handleSetDefault))
-	http.HandleFunc(base+"/api/http/default", requireSession(base, handleSetDefaultHTTP))
-	http.HandleFunc(base+"/api/stream/mapping", requireSession(base, func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc(base+"/api/config", requireSession(base, roleViewer, handleGetConfig))
+	http.HandleFunc(base+"/api/config/revisions", requireSession(base, roleViewer, handleListRevisions))
+	http.HandleFunc(base+"/api/config/revisions/", requireSession(base, roleViewer, makeRevisionHandler(base)))
+	http.HandleFunc(base+"/api/default", requireSession(base, roleOperator, handleSetDefault))
+	http.HandleFunc(base+"/api/http/default", requireSession(base, roleOperator, handleSetDefaultHTTP))
+	http.HandleFunc(base+"/api/stream/mapping", requireSession(base, roleOperator, func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodPost {
 			handleAddMapping(w, r)
 			return
 		}
 		http.Error(w, "method not allowed", 405)
 	}))
-	http.HandleFunc(base+"/api/stream/mapping/", requireSession(base, makeDeleteStreamHandler(base)))
-	http.HandleFunc(base+"/api/http/route", requireSession(base, func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc(base+"/api/stream/mapping/", requireSession(base, roleOperator, makeDeleteStreamHandler(base)))
+	http.HandleFunc(base+"/api/stream/listener", requireSession(base, roleOperator, handleUpsertListener))
+	http.HandleFunc(base+"/api/stream/listener/", requireSession(base, roleOperator, makeDeleteListenerHandler(base)))
+	http.HandleFunc(base+"/api/stream/listen443", requireSession(base, roleOperator, handleSetListen443))
+	http.HandleFunc(base+"/api/http/route", requireSession(base, roleOperator, func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodPost {
 			handleAddHTTPRoute(w, r)
 			return
 		}
 		http.Error(w, "method not allowed", 405)
 	}))
-	http.HandleFunc(base+"/api/http/route/", requireSession(base, makeDeleteHTTPRouteHandler(base)))
-	http.HandleFunc(base+"/api/reload", requireSession(base, handleReload))
-	http.HandleFunc(base+"/api/install-nginx", requireSession(base, handleInstallNginx))
+	http.HandleFunc(base+"/api/http/route/", requireSession(base, roleOperator, makeDeleteHTTPRouteHandler(base)))
+	http.HandleFunc(base+"/api/nginx/include-mode", requireSession(base, roleAdmin, handleSetIncludeMode))
+	http.HandleFunc(base+"/api/preview", requireSession(base, roleOperator, handlePreview))
+	http.HandleFunc(base+"/api/reload", requireSession(base, roleOperator, handleReload))
+	http.HandleFunc(base+"/api/install-nginx", requireSession(base, roleAdmin, handleInstallNginx))
+	http.HandleFunc(base+"/api/account/password", requireSession(base, roleViewer, handleChangePassword))
+	http.HandleFunc(base+"/api/me", requireSession(base, roleViewer, handleMe))
+	http.HandleFunc(base+"/api/account/totp/setup", requireSession(base, roleViewer, handleTOTPSetup))
+	http.HandleFunc(base+"/api/account/totp/enable", requireSession(base, roleViewer, handleTOTPEnable))
+	http.HandleFunc(base+"/api/account/totp/disable", requireSession(base, roleViewer, handleTOTPDisable))
+	http.HandleFunc(base+"/api/users", requireSession(base, roleAdmin, handleUsers))
+	http.HandleFunc(base+"/api/users/", requireSession(base, roleAdmin, makeDeleteUserHandler(base)))
+	http.HandleFunc(base+"/api/lockouts", requireSession(base, roleAdmin, handleLockouts))
+	http.HandleFunc(base+"/api/sessions", requireSession(base, roleViewer, handleSessions))
+	http.HandleFunc(base+"/api/sessions/", requireSession(base, roleViewer, makeSessionHandler(base)))
+	http.HandleFunc(base+"/api/settings/sessions", requireSession(base, roleAdmin, handleSessionSettings))
 
 	// X-UI APIs
-	http.HandleFunc(base+"/api/xui/status", requireSession(base, handleXUIStatus))
-	http.HandleFunc(base+"/api/xui/scan", requireSession(base, handleXUIScan))
-	http.HandleFunc(base+"/api/xui/apply", requireSession(base, handleXUIApply))
+	http.HandleFunc(base+"/api/xui/status", requireSession(base, roleViewer, handleXUIStatus))
+	http.HandleFunc(base+"/api/xui/scan", requireSession(base, roleViewer, handleXUIScan))
+	http.HandleFunc(base+"/api/xui/apply", requireSession(base, roleOperator, handleXUIApply))
+	http.HandleFunc(base+"/api/xui/prune", requireSession(base, roleOperator, handleXUIPrune))
+	http.HandleFunc(base+"/api/xui/sync", requireSession(base, roleViewer, handleXUISync))
+	http.HandleFunc(base+"/api/xui/sync/approve", requireSession(base, roleOperator, handleXUISyncApprove))
+	http.HandleFunc(base+"/api/xui/sync/discard", requireSession(base, roleOperator, handleXUISyncDiscard))
+
+	go watchXUI()
 
 	addr := ":8080"
 	log.Printf("Panel at http://<server-ip>%s", base)
-	log.Printf("ADMIN creds are stored in %s (not in config.json). User: %s", credsPath, cr.User)
+	log.Printf("panel accounts are stored in %s (not in config.json)", usersPath)
 	log.Fatal(http.ListenAndServe(addr, nil))
 }
@@ -2,39 +2,181 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 )
 
-func generateStreamBlock(c Config) string {
-	var mapLines []string
-	mapLines = append(mapLines, "        default "+c.DefaultUP+";")
-	seenSNI := map[string]struct{}{}
-	for _, m := range c.Mappings {
+// streamRoute is one usable map entry after validation and de-duplication.
+type streamRoute struct {
+	key    string // rendered map key
+	alpn   string // "" = any
+	target string // host:port or upstream group name
+	pp     bool
+	group  *Mapping
+}
+
+// streamRoutes returns hash keys first and regexes after, in mapping order,
+// which is also how nginx evaluates them. suffix keeps upstream group names
+// unique across listeners.
+func streamRoutes(ms []Mapping, suffix string) []streamRoute {
+	var out, regex []streamRoute
+	owner := map[string]string{} // hash key / regex -> SNI spelling that claimed it
+	seen := map[string]bool{}    // spelling|alpn
+	for i := range ms {
+		m := &ms[i]
 		host := strings.TrimSpace(m.SNI)
 		up := strings.TrimSpace(m.Upstream)
-		if host == "" || up == "" {
+		if m.isGroup() {
+			up = ""
+			if normalizeServers(m.Servers, m.Balance) == nil {
+				name := host
+				if m.ALPN != alpnAny {
+					name += " " + m.ALPN
+				}
+				up = upstreamName(name) + suffix
+			}
+		}
+		if host == "" || up == "" || validateSNI(host) != nil || validateALPN(m.ALPN) != nil {
+			continue
+		}
+		spelling := strings.ToLower(host)
+		keys := sniHashKeys(host)
+		if sniMatchType(host) == sniRegex {
+			spelling, keys = host, []string{host}
+		}
+		if seen[spelling+"|"+m.ALPN] {
+			continue
+		}
+		taken := false
+		for _, k := range keys {
+			if o, ok := owner[k]; ok && o != spelling {
+				taken = true
+			}
+		}
+		if taken {
 			continue
 		}
-		key := strings.ToLower(host)
-		if _, ok := seenSNI[key]; ok {
+		for _, k := range keys {
+			owner[k] = spelling
+		}
+		seen[spelling+"|"+m.ALPN] = true
+
+		rt := streamRoute{key: mapKey(host), alpn: m.ALPN, target: up, pp: m.ProxyProtocol}
+		if m.isGroup() {
+			rt.group = m
+		}
+		if sniMatchType(host) == sniRegex {
+			regex = append(regex, rt)
+		} else {
+			out = append(out, rt)
+		}
+	}
+	return append(out, regex...)
+}
+
+func generateStreamBlock(c Config) string {
+	var b strings.Builder
+	b.WriteString("stream {\n")
+	seenPort := map[int]bool{}
+	for i, l := range effectiveListeners(c) {
+		if seenPort[l.Port] || normalizeListener(&l) != nil {
 			continue
 		}
-		seenSNI[key] = struct{}{}
-		mapLines = append(mapLines, fmt.Sprintf("        %s %s;", host, up))
+		seenPort[l.Port] = true
+		// the built-in :443 listener keeps the historical variable names
+		suffix := ""
+		if i > 0 || !c.ListenPort443 {
+			suffix = "_" + strconv.Itoa(l.Port)
+		}
+		b.WriteString(generateStreamListener(l, suffix))
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func generateStreamListener(l StreamListener, suffix string) string {
+	routes := streamRoutes(l.Mappings, suffix)
+	unknown, noSNI, needReject := unknownAndNoSNI(l, suffix)
+	if noSNI != "" {
+		// first regex, so no user pattern can swallow the empty name
+		routes = append([]streamRoute{{key: `"~^$"`, target: noSNI}}, routes...)
+	}
+	backend, relayVar, alpnVar := "$backend"+suffix, "$relay"+suffix, "$alpn"+suffix
+	var b strings.Builder
+	if needReject {
+		b.WriteString("    server {\n        listen unix:" + suffixedSock(rejectSock, suffix) + ";\n        return \"\";\n    }\n")
+	}
+	anyPP, anyALPN := l.DefaultProxyProtocol, false
+	for _, rt := range routes {
+		if rt.group != nil {
+			b.WriteString(generateUpstreamGroup(rt.target, *rt.group))
+		}
+		anyPP = anyPP || rt.pp
+		anyALPN = anyALPN || rt.alpn != alpnAny
+	}
+	if anyALPN {
+		b.WriteString(generateALPNMap(alpnVar, routes))
+	}
+	b.WriteString(generateRouteMap(backend, alpnVar, unknown, routes, func(rt streamRoute) string { return rt.target }))
+
+	listen := func() {
+		for _, d := range listenDirectives(l) {
+			b.WriteString("        " + d + "\n")
+		}
+	}
+	if !anyPP {
+		b.WriteString("    server {\n")
+		listen()
+		b.WriteString("        proxy_pass " + backend + ";\n        ssl_preread on;\n    }\n")
+		return b.String()
+	}
+
+	// proxy_protocol cannot depend on a variable, so the public listener
+	// always speaks PROXY to one of two local relays and the relay picked by
+	// $relay decides whether the real backend gets the header too.
+	plainSock, ppSock := relaySocks(suffix)
+	relay := func(pp bool) string {
+		if pp {
+			return "unix:" + ppSock
+		}
+		return "unix:" + plainSock
 	}
-	return "stream {\n    map $ssl_preread_server_name $backend {\n" +
-		strings.Join(mapLines, "\n") + `
+	// rejected connections never get a PROXY header
+	b.WriteString(generateRouteMap(relayVar, alpnVar, relay(l.DefaultProxyProtocol && !l.RejectUnknownSNI), routes, func(rt streamRoute) string { return relay(rt.pp) }))
+	b.WriteString("    server {\n")
+	listen()
+	b.WriteString("        proxy_pass " + relayVar + ";\n        proxy_protocol on;\n        ssl_preread on;\n    }\n")
+	b.WriteString(`    server {
+        listen unix:` + plainSock + ` proxy_protocol;
+        set_real_ip_from unix:;
+        proxy_pass ` + backend + `;
+        ssl_preread on;
     }
     server {
-        listen 443 reuseport;
-        listen [::]:443 reuseport;
-        proxy_pass $backend;
+        listen unix:` + ppSock + ` proxy_protocol;
+        set_real_ip_from unix:;
+        proxy_pass ` + backend + `;
+        proxy_protocol on;
         ssl_preread on;
     }
+`)
+	return b.String()
 }
-`
+
+func suffixedSock(sock, suffix string) string {
+	return strings.Replace(sock, ".sock", suffix+".sock", 1)
+}
+
+func relaySocks(suffix string) (plain, pp string) {
+	return suffixedSock(plainRelaySock, suffix), suffixedSock(ppRelaySock, suffix)
 }
 
 func baseHTTPCommon() string {
@@ -61,12 +203,44 @@ func baseProxyCommon() string {
 `
 }
 
+// websocketProxyCommon is baseProxyCommon with the Upgrade handshake passed
+// through instead of the keepalive Connection header.
+func websocketProxyCommon() string {
+	return `
+    proxy_set_header Host $host;
+    proxy_set_header X-Real-IP $remote_addr;
+    proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
+    proxy_set_header X-Forwarded-Proto $scheme;
+    proxy_http_version 1.1;
+    proxy_set_header Upgrade $http_upgrade;
+    proxy_set_header Connection $connection_upgrade;
+    proxy_read_timeout 1h;
+    proxy_send_timeout 1h;
+`
+}
+
+func connectionUpgradeMap() string {
+	return `map $http_upgrade $connection_upgrade {
+    default upgrade;
+    "" close;
+}
+
+`
+}
+
 func generateHTTPServers(c Config) string {
 	if !c.HTTPEnabled {
 		return "http {\n" + baseHTTPCommon() + "}\n"
 	}
+	return "http {\n" + baseHTTPCommon() + generateHTTPServerBlocks(c, true) + "}\n"
+}
+
+// generateHTTPServerBlocks renders the per-host servers. The catch-all
+// default_server is left out in include mode, where the host config owns it.
+func generateHTTPServerBlocks(c Config, defaultServer bool) string {
 	var b strings.Builder
 	common := baseProxyCommon()
+	b.WriteString(connectionUpgradeMap())
 
 	for _, h := range c.HTTPHosts {
 		host := strings.TrimSpace(h.Host)
@@ -77,19 +251,20 @@ func generateHTTPServers(c Config) string {
 		b.WriteString("server {\n")
 		b.WriteString("    listen 80 reuseport;\n")
 		b.WriteString("    listen [::]:80 reuseport;\n")
-		b.WriteString(fmt.Sprintf("    server_name %s;\n\n", host))
+		b.WriteString(fmt.Sprintf("    server_name %s;\n", host))
+		b.WriteString("\n")
 
 		for _, p := range h.Paths {
 			pp := strings.TrimSpace(p.PathPrefix)
 			up := strings.TrimSpace(p.Upstream)
-			if pp == "" || pp[0] != '/' || up == "" {
+			if pp == "" || pp[0] != '/' || up == "" || p.transport() == transportGRPC {
 				continue
 			}
 			if _, ok := seenLoc[pp]; ok {
 				continue
 			}
 			seenLoc[pp] = struct{}{}
-			b.WriteString(fmt.Sprintf("    location ^~ %s {\n        proxy_pass http://%s;%s    }\n\n", pp, up, common))
+			b.WriteString(pathLocation(pp, up, p.transport()))
 		}
 
 		if strings.TrimSpace(h.Fallback) != "" {
@@ -100,8 +275,15 @@ func generateHTTPServers(c Config) string {
 			b.WriteString("    location / { return 404; }\n")
 		}
 		b.WriteString("}\n\n")
+
+		if hasGRPCPath(h) {
+			b.WriteString(grpcServerBlock(host, h.Paths, c.grpcPort()))
+		}
 	}
 
+	if !defaultServer {
+		return b.String()
+	}
 	b.WriteString("server {\n")
 	b.WriteString("    listen 80 default_server reuseport;\n")
 	b.WriteString("    listen [::]:80 default_server reuseport;\n")
@@ -112,12 +294,11 @@ func generateHTTPServers(c Config) string {
 		b.WriteString("    return 444;\n")
 	}
 	b.WriteString("}\n")
-
-	return "http {\n" + baseHTTPCommon() + b.String() + "}\n"
+	return b.String()
 }
 
 func generateNginxConf(c Config) string {
-	return `user www-data;
+	return generatedHeader + `user www-data;
 worker_processes auto;
 worker_rlimit_nofile 2000000;
 pid /run/nginx.pid;
@@ -129,11 +310,145 @@ events { use epoll; worker_connections 131072; multi_accept on; }
 ` + generateHTTPServers(c)
 }
 
-func writeNginxConf(c Config) error { return writeAtomic(nginxConf, []byte(generateNginxConf(c)), 0644) }
+const (
+	generatedHeader = "# generated by snirouter (full mode); the original is kept as nginx.conf.snirouter-orig\n"
+	managedMarker   = "# managed by snirouter"
+)
+
+func streamIncludePath() string { return filepath.Join(nginxIncludeDir, "stream.conf") }
+func httpIncludePath() string   { return filepath.Join(nginxIncludeDir, "http.conf") }
+
+// managedPaths lists every file snirouter may write, in either mode.
+func managedPaths() []string { return []string{nginxConf, streamIncludePath(), httpIncludePath()} }
+
+func isGeneratedConf(b []byte) bool { return bytes.HasPrefix(b, []byte(generatedHeader)) }
+
+// backupOriginalNginx keeps one copy of the host's own nginx.conf before
+// snirouter first modifies it.
+func backupOriginalNginx() error {
+	if _, err := os.Stat(nginxOrigBackup); err == nil {
+		return nil
+	}
+	b, err := os.ReadFile(nginxConf)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if isGeneratedConf(b) {
+		return nil
+	}
+	return os.WriteFile(nginxOrigBackup, b, 0644)
+}
+
+var reHTTPBlockOpen = regexp.MustCompile(`(?m)^\s*http\s*\{[^\n]*\n`)
 
-func nginxTest() error {
+// includeMainConf returns the host nginx.conf with the snirouter include
+// lines added: stream.conf at main level and http.conf inside http {}.
+// A main config previously generated in full mode is replaced by the
+// original backup.
+func includeMainConf() (string, error) {
+	b, err := os.ReadFile(nginxConf)
+	if err != nil {
+		return "", err
+	}
+	if isGeneratedConf(b) {
+		if b, err = os.ReadFile(nginxOrigBackup); err != nil {
+			return "", fmt.Errorf("%s is generated by snirouter and no original backup exists: %v", nginxConf, err)
+		}
+	}
+	txt := string(b)
+	if strings.Contains(txt, managedMarker) {
+		return txt, nil
+	}
+	httpLine := fmt.Sprintf("    include %s; %s\n", httpIncludePath(), managedMarker)
+	if loc := reHTTPBlockOpen.FindStringIndex(txt); loc != nil {
+		txt = txt[:loc[1]] + httpLine + txt[loc[1]:]
+	} else {
+		txt = strings.TrimRight(txt, "\n") + "\n\nhttp {\n" + httpLine + "}\n"
+	}
+	txt = strings.TrimRight(txt, "\n") + fmt.Sprintf("\n\ninclude %s; %s\n", streamIncludePath(), managedMarker)
+	return txt, nil
+}
+
+// nginxFiles renders every file snirouter owns for c, keyed by path.
+// proxyProtocolRoutes names what in c makes stream listeners send PROXY
+// headers.
+func proxyProtocolRoutes(c Config) []string {
+	var out []string
+	for _, l := range effectiveListeners(c) {
+		if l.DefaultProxyProtocol {
+			out = append(out, fmt.Sprintf("the default route of :%d", l.Port))
+		}
+		for _, m := range l.Mappings {
+			if m.ProxyProtocol {
+				out = append(out, m.SNI)
+			}
+		}
+	}
+	return out
+}
+
+// checkStreamRealIP refuses PROXY protocol routes when the installed nginx
+// lacks ngx_stream_realip_module, which the local relays need; nginx -t would
+// only report an unknown directive.
+func checkStreamRealIP(c Config) error {
+	routes := proxyProtocolRoutes(c)
+	if len(routes) == 0 {
+		return nil
+	}
+	out, err := exec.Command("nginx", "-V").CombinedOutput()
+	if err != nil || bytes.Contains(out, []byte("--with-stream_realip_module")) {
+		return nil // no nginx to ask; nginx -t reports that
+	}
+	return fmt.Errorf("PROXY protocol needs nginx built with ngx_stream_realip_module, which the installed nginx lacks; turn it off for %s or install nginx-full",
+		strings.Join(routes, ", "))
+}
+
+func nginxFiles(c Config) (map[string]string, error) {
+	if err := checkStreamRealIP(c); err != nil {
+		return nil, err
+	}
+	if !c.IncludeMode {
+		return map[string]string{nginxConf: generateNginxConf(c)}, nil
+	}
+	main, err := includeMainConf()
+	if err != nil {
+		return nil, err
+	}
+	httpConf := managedMarker + "\n"
+	if c.HTTPEnabled {
+		httpConf += generateHTTPServerBlocks(c, false)
+	}
+	return map[string]string{
+		nginxConf:           main,
+		streamIncludePath(): managedMarker + "\n" + generateStreamBlock(c),
+		httpIncludePath():   httpConf,
+	}, nil
+}
+
+func writeNginxConf(c Config) error {
+	if err := backupOriginalNginx(); err != nil {
+		return err
+	}
+	files, err := nginxFiles(c)
+	if err != nil {
+		return err
+	}
+	for _, p := range managedPaths() {
+		if data, ok := files[p]; ok {
+			if err := writeAtomic(p, []byte(data), 0644); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func nginxTest(args ...string) error {
 	var out bytes.Buffer
-	cmd := exec.Command("nginx", "-t")
+	cmd := exec.Command("nginx", append([]string{"-t"}, args...)...)
 	cmd.Stdout, cmd.Stderr = &out, &out
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("nginx -t failed: %v\n%s", err, out.String())
@@ -141,6 +456,53 @@ func nginxTest() error {
 	return nil
 }
 
+// previewNginxConf renders c, runs nginx -t on a scratch copy and diffs it
+// against the active files. Nothing under /etc is touched.
+func previewNginxConf(c Config) (NginxPreview, error) {
+	var p NginxPreview
+	files, err := nginxFiles(c)
+	if err != nil {
+		return p, err
+	}
+
+	dir, err := os.MkdirTemp("", "snirouter-preview-")
+	if err != nil {
+		return p, err
+	}
+	defer os.RemoveAll(dir)
+
+	var rendered, diff strings.Builder
+	for _, path := range managedPaths() {
+		data, ok := files[path]
+		if !ok {
+			continue
+		}
+		cur, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return p, err
+		}
+		if len(files) > 1 {
+			fmt.Fprintf(&rendered, "# ==> %s <==\n", path)
+		}
+		rendered.WriteString(data)
+		diff.WriteString(unifiedDiff(path, path+" (proposed)", string(cur), data))
+
+		// point the scratch main config at the scratch includes
+		scratch := strings.ReplaceAll(data, nginxIncludeDir, dir)
+		if err := os.WriteFile(filepath.Join(dir, filepath.Base(path)), []byte(scratch), 0644); err != nil {
+			return p, err
+		}
+	}
+	p.Rendered, p.Diff = rendered.String(), diff.String()
+
+	if err := nginxTest("-c", filepath.Join(dir, filepath.Base(nginxConf))); err != nil {
+		p.TestOutput = err.Error()
+	} else {
+		p.TestOK = true
+	}
+	return p, nil
+}
+
 func nginxReload() error {
 	if _, err := exec.LookPath("systemctl"); err == nil {
 		return sudoRun("bash", "-lc", "systemctl reload nginx || systemctl restart nginx")
@@ -148,6 +510,111 @@ func nginxReload() error {
 	return sudoRun("nginx", "-s", "reload")
 }
 
+// applyError is returned when a generated config was rejected by nginx and
+// the previous known-good state had to be put back.
+type applyError struct {
+	cause    error
+	restored []string
+}
+
+func (e *applyError) Error() string {
+	if len(e.restored) == 0 {
+		return e.cause.Error() + "\n(nothing to roll back: no known-good config yet)"
+	}
+	return e.cause.Error() + "\nrolled back: " + strings.Join(e.restored, ", ")
+}
+
+func (e *applyError) Unwrap() error { return e.cause }
+
+// snapshotNginxFiles reads all managed files; missing ones map to nil.
+func snapshotNginxFiles() (map[string][]byte, error) {
+	snap := map[string][]byte{}
+	for _, p := range managedPaths() {
+		b, err := os.ReadFile(p)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		snap[p] = b
+	}
+	return snap, nil
+}
+
+func saveKnownGood(c Config) {
+	if snap, err := snapshotNginxFiles(); err == nil {
+		_ = writeAtomic(goodNginxPath, mustJSON(snap), 0600)
+	}
+	_ = writeAtomic(goodConfigPath, mustJSON(c), 0644)
+}
+
+// seedKnownGood records the state found at startup as known-good when there
+// is none yet (first run, or an upgrade from a version without rollback), so
+// the first failed apply also has a config.json to go back to. A state nginx
+// rejects is not recorded.
+func seedKnownGood(c Config) {
+	if _, err := os.Stat(goodConfigPath); err == nil {
+		return
+	}
+	if err := nginxTest(); err != nil {
+		log.Printf("not recording the current config as known-good: %v", err)
+		return
+	}
+	saveKnownGood(c)
+	log.Printf("recorded the current config as known-good")
+}
+
+// rollback puts back nginx.conf as it was before this apply and the include
+// files from the last known-good snapshot (or, without one, from before this
+// apply too), together with the matching config.json. nginx.conf never comes
+// from the snapshot: in include mode the host owns it, and a snapshot taken
+// in full mode would overwrite it with a generated one. Caller must hold
+// configMutex.
+func rollback(cause error, prev map[string][]byte, reloaded bool) error {
+	ae := &applyError{cause: cause}
+	var good map[string][]byte
+	if b, err := os.ReadFile(goodNginxPath); err == nil {
+		_ = json.Unmarshal(b, &good)
+	}
+	for _, p := range managedPaths() {
+		want := prev[p]
+		if p != nginxConf && good[p] != nil {
+			want = good[p]
+		}
+		cur, err := os.ReadFile(p)
+		if want == nil {
+			if err == nil && os.Remove(p) == nil {
+				ae.restored = append(ae.restored, p+" (removed)")
+			}
+			continue
+		}
+		if err == nil && bytes.Equal(cur, want) {
+			continue
+		}
+		if werr := writeAtomic(p, want, 0644); werr == nil {
+			ae.restored = append(ae.restored, p)
+		} else {
+			log.Printf("rollback: restore %s: %v", p, werr)
+		}
+	}
+	if b, err := os.ReadFile(goodConfigPath); err == nil {
+		if werr := writeAtomic(configPath, b, 0644); werr == nil {
+			ae.restored = append(ae.restored, configPath)
+			var c Config
+			if json.Unmarshal(b, &c) == nil {
+				_ = recordRevision(c, "system", "automatic rollback after failed apply")
+			}
+		} else {
+			log.Printf("rollback: restore %s: %v", configPath, werr)
+		}
+	}
+	if reloaded && len(ae.restored) > 0 {
+		if rerr := nginxReload(); rerr != nil {
+			log.Printf("rollback: reload restored config: %v", rerr)
+		}
+	}
+	log.Printf("apply failed (%v); rolled back: %v", cause, ae.restored)
+	return ae
+}
+
 func applyAndReload() error {
 	configMutex.Lock()
 	defer configMutex.Unlock()
@@ -155,11 +622,20 @@ func applyAndReload() error {
 	if err != nil {
 		return err
 	}
-	if err := writeNginxConf(cfg); err != nil {
+	prev, err := snapshotNginxFiles()
+	if err != nil {
 		return err
 	}
+	if err := writeNginxConf(cfg); err != nil {
+		// include mode writes several files; don't leave half of them behind
+		return rollback(err, prev, false)
+	}
 	if err := nginxTest(); err != nil {
-		return err
+		return rollback(err, prev, false)
 	}
-	return nginxReload()
+	if err := nginxReload(); err != nil {
+		return rollback(fmt.Errorf("nginx reload failed: %v", err), prev, true)
+	}
+	saveKnownGood(cfg)
+	return nil
 }
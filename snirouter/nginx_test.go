@@ -0,0 +1,376 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// mapBlock is one parsed nginx map, enough to evaluate the stream maps the
+// generator emits.
+type mapBlock struct {
+	source, target string
+	hostnames      bool
+	def            string
+	exact          map[string]string
+	keys           [][2]string // non-exact keys in order
+}
+
+var reMapBlock = regexp.MustCompile(`(?ms)^\s*map ("[^"]*"|\S+) (\$\w+) \{\n(.*?)\n\s*\}`)
+
+func parseMaps(t *testing.T, conf string) []mapBlock {
+	t.Helper()
+	var out []mapBlock
+	for _, m := range reMapBlock.FindAllStringSubmatch(conf, -1) {
+		b := mapBlock{source: strings.Trim(m[1], `"`), target: m[2], exact: map[string]string{}}
+		for _, ln := range strings.Split(m[3], "\n") {
+			ln = strings.TrimSuffix(strings.TrimSpace(ln), ";")
+			if ln == "hostnames" {
+				b.hostnames = true
+				continue
+			}
+			var key, val string
+			if strings.HasPrefix(ln, `"`) {
+				end := strings.Index(ln[1:], `"`) + 1
+				key, val = ln[1:end], strings.TrimSpace(ln[end+1:])
+			} else {
+				key, val, _ = strings.Cut(ln, " ")
+			}
+			switch {
+			case key == "default":
+				b.def = val
+			case strings.HasPrefix(key, "~") || b.hostnames && strings.Contains(key, "*") || b.hostnames && strings.HasPrefix(key, "."):
+				b.keys = append(b.keys, [2]string{key, val})
+			default:
+				b.exact[key] = val
+			}
+		}
+		out = append(out, b)
+	}
+	if len(out) == 0 {
+		t.Fatalf("no maps in\n%s", conf)
+	}
+	return out
+}
+
+// lookup follows nginx: exact name, longest leading wildcard, longest
+// trailing wildcard (hostnames maps only), then regexes in order.
+func (b mapBlock) lookup(s string) string {
+	if b.hostnames {
+		s = strings.ToLower(s)
+	}
+	if v, ok := b.exact[s]; ok {
+		return v
+	}
+	if b.hostnames {
+		best, bestLen := "", -1
+		for _, kv := range b.keys {
+			k := kv[0]
+			var suffix string
+			switch {
+			case strings.HasPrefix(k, "*."):
+				suffix = k[1:]
+			case strings.HasPrefix(k, "."):
+				if s == k[1:] && len(k) > bestLen {
+					best, bestLen = kv[1], len(k)
+				}
+				suffix = k
+			default:
+				continue
+			}
+			if strings.HasSuffix(s, suffix) && len(k) > bestLen {
+				best, bestLen = kv[1], len(k)
+			}
+		}
+		if bestLen >= 0 {
+			return best
+		}
+		for _, kv := range b.keys {
+			if k := kv[0]; strings.HasSuffix(k, ".*") && strings.HasPrefix(s, k[:len(k)-1]) && len(k) > bestLen {
+				best, bestLen = kv[1], len(k)
+			}
+		}
+		if bestLen >= 0 {
+			return best
+		}
+	}
+	for _, kv := range b.keys {
+		expr, ok := strings.CutPrefix(kv[0], "~")
+		if !ok {
+			continue
+		}
+		if rest, ok := strings.CutPrefix(expr, "*"); ok {
+			expr = "(?i)" + rest
+		}
+		re := regexp.MustCompile(expr)
+		if m := re.FindStringSubmatch(s); m != nil {
+			v := kv[1]
+			for i, name := range re.SubexpNames() {
+				if name != "" {
+					v = strings.ReplaceAll(v, "$"+name, m[i])
+				}
+			}
+			return v
+		}
+	}
+	return b.def
+}
+
+// evalMaps runs every map in order for a connection with the given server
+// name and ALPN list and returns the resulting variables.
+func evalMaps(maps []mapBlock, sni, alpn string) map[string]string {
+	vars := map[string]string{"$ssl_preread_server_name": sni, "$ssl_preread_alpn_protocols": alpn}
+	reVar := regexp.MustCompile(`\$\w+`)
+	for _, b := range maps {
+		src := reVar.ReplaceAllStringFunc(b.source, func(v string) string { return vars[v] })
+		vars[b.target] = b.lookup(src)
+	}
+	return vars
+}
+
+const (
+	plainRelay = "unix:/run/snirouter-plain.sock"
+	ppRelay    = "unix:/run/snirouter-pp.sock"
+)
+
+func TestStreamMapsRouting(t *testing.T) {
+	group := Mapping{SNI: "*.g.com", Balance: balanceHash, Servers: []UpstreamServer{{Address: "10.0.9.1:443", Weight: 2}, {Address: "10.0.9.2:443", MaxFails: 3, FailTimeout: "10s"}}}
+	ppGroup := Mapping{SNI: "pg.com", ALPN: "h2", ProxyProtocol: true, Servers: []UpstreamServer{{Address: "10.0.8.1:443"}, {Address: "10.0.8.2:443", Backup: true}}}
+	groupName := upstreamName("*.g.com")
+	ppGroupName := upstreamName("pg.com h2")
+
+	listeners := []struct {
+		name string
+		l    StreamListener
+		// sni, alpn list -> backend, relay ("" when there is no relay)
+		cases [][4]string
+	}{
+		{
+			name: "sni kinds",
+			l: StreamListener{Port: 443, IPv4: true, DefaultUP: "127.0.0.1:8443", Mappings: []Mapping{
+				{SNI: "Exact.com", Upstream: "10.0.0.1:443"},
+				{SNI: "*.w.com", Upstream: "10.0.0.2:443"},
+				{SNI: "*.deep.w.com", Upstream: "10.0.0.3:443"},
+				{SNI: ".s.com", Upstream: "10.0.0.4:443"},
+				{SNI: "*.s.com", Upstream: "10.0.0.99:443"}, // taken by .s.com, dropped
+				{SNI: "www.s.com", Upstream: "10.0.0.5:443"},
+				{SNI: "mail.*", Upstream: "10.0.0.6:443"},
+				{SNI: `~^api\d+\.r\.com$`, Upstream: "10.0.0.7:443"},
+				{SNI: `~*^CASE\.r\.com$`, Upstream: "10.0.0.8:443"},
+				{SNI: `~^mail`, Upstream: "10.0.0.99:443"}, // trailing wildcard wins
+				{SNI: "bad sni", Upstream: "10.0.0.99:443"},
+				group,
+			}},
+			cases: [][4]string{
+				{"exact.com", "", "10.0.0.1:443"},
+				{"EXACT.com", "h2", "10.0.0.1:443"},
+				{"a.w.com", "", "10.0.0.2:443"},
+				{"w.com", "", "127.0.0.1:8443"},
+				{"a.deep.w.com", "", "10.0.0.3:443"},
+				{"s.com", "", "10.0.0.4:443"},
+				{"x.s.com", "", "10.0.0.4:443"},
+				{"www.s.com", "", "10.0.0.5:443"},
+				{"mail.example.org", "", "10.0.0.6:443"},
+				{"api12.r.com", "", "10.0.0.7:443"},
+				{"apix.r.com", "", "127.0.0.1:8443"},
+				{"case.r.com", "", "10.0.0.8:443"},
+				{"a.g.com", "", groupName},
+				{"unknown.org", "", "127.0.0.1:8443"},
+				{"", "", "127.0.0.1:8443"},
+			},
+		},
+		{
+			name: "alpn",
+			l: StreamListener{Port: 443, IPv4: true, DefaultUP: "127.0.0.1:8443", Mappings: []Mapping{
+				{SNI: "a.com", ALPN: "h2", Upstream: "10.0.1.1:443"},
+				{SNI: "a.com", ALPN: "http/1.1", Upstream: "10.0.1.2:443"},
+				{SNI: "a.com", Upstream: "10.0.1.3:443"},
+				{SNI: "n.com", ALPN: alpnNone, Upstream: "10.0.1.4:443"},
+				{SNI: ".w.com", ALPN: "h2", Upstream: "10.0.1.5:443"},
+				{SNI: "plain.com", Upstream: "10.0.1.6:443"},
+			}},
+			cases: [][4]string{
+				{"a.com", "h2,http/1.1", "10.0.1.1:443"},
+				{"a.com", "http/1.1,h2", "10.0.1.2:443"},
+				{"a.com", "h3", "10.0.1.3:443"},
+				{"a.com", "h2c", "10.0.1.3:443"}, // h2 only matches whole ids
+				{"a.com", "", "10.0.1.3:443"},
+				{"n.com", "", "10.0.1.4:443"},
+				{"n.com", "h2", "127.0.0.1:8443"},
+				{"x.w.com", "h2", "10.0.1.5:443"},
+				{"x.w.com", "http/1.1", "127.0.0.1:8443"},
+				{"plain.com", "h2", "10.0.1.6:443"},
+				{"other.com", "h2", "127.0.0.1:8443"},
+			},
+		},
+		{
+			name: "proxy protocol",
+			l: StreamListener{Port: 443, IPv4: true, DefaultUP: "127.0.0.1:8443", Mappings: []Mapping{
+				{SNI: "pp.com", Upstream: "10.0.2.1:443", ProxyProtocol: true},
+				{SNI: "plain.com", Upstream: "10.0.2.2:443"},
+				{SNI: "mixed.com", ALPN: "h2", Upstream: "10.0.2.3:443", ProxyProtocol: true},
+				{SNI: "mixed.com", Upstream: "10.0.2.4:443"},
+				{SNI: `~^re\d\.com$`, Upstream: "10.0.2.5:443", ProxyProtocol: true},
+				ppGroup,
+			}},
+			cases: [][4]string{
+				{"pp.com", "", "10.0.2.1:443", ppRelay},
+				{"plain.com", "", "10.0.2.2:443", plainRelay},
+				{"mixed.com", "h2", "10.0.2.3:443", ppRelay},
+				{"mixed.com", "http/1.1", "10.0.2.4:443", plainRelay},
+				{"re1.com", "", "10.0.2.5:443", ppRelay},
+				{"pg.com", "h2", ppGroupName, ppRelay},
+				{"pg.com", "", "127.0.0.1:8443", plainRelay},
+				{"unknown.org", "", "127.0.0.1:8443", plainRelay},
+			},
+		},
+		{
+			name: "proxy protocol default with rejection",
+			l: StreamListener{Port: 443, IPv4: true, DefaultUP: "127.0.0.1:8443", DefaultProxyProtocol: true,
+				RejectUnknownSNI: true, NoSNIUpstream: noSNIReject, Mappings: []Mapping{
+					{SNI: "plain.com", Upstream: "10.0.3.1:443"},
+				}},
+			cases: [][4]string{
+				{"plain.com", "", "10.0.3.1:443", plainRelay},
+				{"unknown.org", "", "unix:/run/snirouter-reject.sock", plainRelay},
+				{"", "", "unix:/run/snirouter-reject.sock", plainRelay},
+			},
+		},
+		{
+			name: "proxy protocol default",
+			l: StreamListener{Port: 443, IPv4: true, DefaultUP: "127.0.0.1:8443", DefaultProxyProtocol: true,
+				NoSNIUpstream: "127.0.0.1:9000", Mappings: []Mapping{
+					{SNI: "plain.com", Upstream: "10.0.4.1:443"},
+				}},
+			cases: [][4]string{
+				{"plain.com", "", "10.0.4.1:443", plainRelay},
+				{"unknown.org", "", "127.0.0.1:8443", ppRelay},
+				{"", "h2", "127.0.0.1:9000", plainRelay},
+			},
+		},
+	}
+
+	for _, tl := range listeners {
+		conf := generateStreamListener(tl.l, "")
+		maps := parseMaps(t, conf)
+		hasRelay := strings.Contains(conf, "$relay")
+		for _, c := range tl.cases {
+			vars := evalMaps(maps, c[0], c[1])
+			if got := vars["$backend"]; got != c[2] {
+				t.Errorf("%s: %q alpn %q -> backend %q, want %q", tl.name, c[0], c[1], got, c[2])
+			}
+			if got := vars["$relay"]; hasRelay && got != c[3] || !hasRelay && c[3] != "" {
+				t.Errorf("%s: %q alpn %q -> relay %q, want %q", tl.name, c[0], c[1], got, c[3])
+			}
+		}
+	}
+}
+
+func TestStreamListenerBlocks(t *testing.T) {
+	group := Mapping{SNI: "g.com", Balance: balanceHash, Servers: []UpstreamServer{
+		{Address: "10.0.9.1:443", Weight: 2, MaxFails: 3, FailTimeout: "10s"}, {Address: "10.0.9.2:443"}}}
+	tests := []struct {
+		name      string
+		l         StreamListener
+		want, not []string
+	}{
+		{
+			name: "plain",
+			l:    StreamListener{Port: 443, IPv4: true, IPv6: true, ReusePort: true, DefaultUP: "127.0.0.1:8443", Mappings: []Mapping{{SNI: "a.com", Upstream: "10.0.0.1:443"}}},
+			want: []string{"listen 443 reuseport;", "listen [::]:443 reuseport;", "proxy_pass $backend;"},
+			not:  []string{"proxy_protocol", "$alpn", "upstream ", "snirouter-reject"},
+		},
+		{
+			name: "group",
+			l:    StreamListener{Port: 443, IPv4: true, DefaultUP: "127.0.0.1:8443", Mappings: []Mapping{group}},
+			want: []string{"upstream " + upstreamName("g.com") + " {\n        hash $remote_addr;\n" +
+				"        server 10.0.9.1:443 weight=2 max_fails=3 fail_timeout=10s;\n        server 10.0.9.2:443;\n    }"},
+		},
+		{
+			name: "invalid group is dropped",
+			l: StreamListener{Port: 443, IPv4: true, DefaultUP: "127.0.0.1:8443", Mappings: []Mapping{
+				{SNI: "g.com", Servers: []UpstreamServer{{Address: "10.0.9.1:443", Backup: true}}}}},
+			not: []string{"upstream ", "g.com"},
+		},
+		{
+			name: "proxy protocol relays",
+			l:    StreamListener{Port: 443, IPv4: true, DefaultUP: "127.0.0.1:8443", Mappings: []Mapping{{SNI: "a.com", Upstream: "10.0.0.1:443", ProxyProtocol: true}}},
+			want: []string{
+				"        listen 443;\n        proxy_pass $relay;\n        proxy_protocol on;",
+				"        listen unix:" + plainRelaySock + " proxy_protocol;\n        set_real_ip_from unix:;\n        proxy_pass $backend;",
+				"        listen unix:" + ppRelaySock + " proxy_protocol;\n        set_real_ip_from unix:;\n        proxy_pass $backend;\n        proxy_protocol on;",
+			},
+		},
+		{
+			name: "reject socket",
+			l:    StreamListener{Port: 443, IPv4: true, DefaultUP: "127.0.0.1:8443", RejectUnknownSNI: true},
+			want: []string{"listen unix:" + rejectSock + ";\n        return \"\";"},
+		},
+		{
+			name: "blackhole instead of the reject socket",
+			l:    StreamListener{Port: 443, IPv4: true, DefaultUP: "127.0.0.1:8443", RejectUnknownSNI: true, BlackholeUP: "127.0.0.1:9"},
+			want: []string{"default 127.0.0.1:9;"},
+			not:  []string{rejectSock},
+		},
+		{
+			name: "bind",
+			l:    StreamListener{Port: 8443, Bind: "::1", IPv4: true, DefaultUP: "127.0.0.1:8443"},
+			want: []string{"listen [::1]:8443;"},
+			not:  []string{"listen 8443;"},
+		},
+	}
+	for _, tt := range tests {
+		conf := generateStreamListener(tt.l, "")
+		for _, w := range tt.want {
+			if !strings.Contains(conf, w) {
+				t.Errorf("%s: missing %q in\n%s", tt.name, w, conf)
+			}
+		}
+		for _, n := range tt.not {
+			if strings.Contains(conf, n) {
+				t.Errorf("%s: unexpected %q in\n%s", tt.name, n, conf)
+			}
+		}
+	}
+}
+
+func TestStreamBlockListenerSuffixes(t *testing.T) {
+	group := Mapping{SNI: "g.com", Servers: []UpstreamServer{{Address: "10.0.9.1:443"}}}
+	c := Config{
+		ListenPort443: true, DefaultUP: "127.0.0.1:8443",
+		Mappings: []Mapping{{SNI: "a.com", Upstream: "10.0.0.1:443", ProxyProtocol: true}, group},
+		StreamListeners: []StreamListener{
+			{Port: 8443, IPv4: true, DefaultUP: "127.0.0.1:9443", RejectUnknownSNI: true,
+				Mappings: []Mapping{{SNI: "a.com", Upstream: "10.0.5.1:443", ProxyProtocol: true}, group}},
+			{Port: 8443, IPv4: true, DefaultUP: "127.0.0.1:1"}, // duplicate port, skipped
+		},
+	}
+	conf := generateStreamBlock(c)
+	for _, w := range []string{
+		"upstream " + upstreamName("g.com") + " {",
+		"upstream " + upstreamName("g.com") + "_8443 {",
+		"listen unix:/run/snirouter-plain_8443.sock proxy_protocol;",
+		"listen unix:/run/snirouter-reject_8443.sock;",
+		"proxy_pass $relay_8443;",
+	} {
+		if !strings.Contains(conf, w) {
+			t.Errorf("missing %q in\n%s", w, conf)
+		}
+	}
+	if n := strings.Count(conf, "listen 8443;"); n != 1 {
+		t.Errorf("port 8443 rendered %d times", n)
+	}
+
+	maps := parseMaps(t, conf)
+	vars := evalMaps(maps, "a.com", "")
+	if vars["$backend"] != "10.0.0.1:443" || vars["$backend_8443"] != "10.0.5.1:443" {
+		t.Errorf("a.com -> %q / %q", vars["$backend"], vars["$backend_8443"])
+	}
+	if vars["$relay_8443"] != "unix:/run/snirouter-pp_8443.sock" {
+		t.Errorf("a.com relay on 8443 -> %q", vars["$relay_8443"])
+	}
+	vars = evalMaps(maps, "other.org", "")
+	if vars["$backend_8443"] != "unix:/run/snirouter-reject_8443.sock" || vars["$relay_8443"] != "unix:/run/snirouter-plain_8443.sock" {
+		t.Errorf("unknown name on 8443 -> %q via %q", vars["$backend_8443"], vars["$relay_8443"])
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func revisionFile(id int) string {
+	return filepath.Join(revisionsDir, fmt.Sprintf("%06d.json", id))
+}
+
+func revisionIDs() ([]int, error) {
+	ents, err := os.ReadDir(revisionsDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var ids []int
+	for _, e := range ents {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		if id, err := strconv.Atoi(strings.TrimSuffix(name, ".json")); err == nil && id > 0 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+func loadRevision(id int) (ConfigRevision, error) {
+	var rev ConfigRevision
+	b, err := os.ReadFile(revisionFile(id))
+	if err != nil {
+		return rev, err
+	}
+	if err := json.Unmarshal(b, &rev); err != nil {
+		return rev, fmt.Errorf("revision %d: %v", id, err)
+	}
+	if rev.Config == nil {
+		return rev, fmt.Errorf("revision %d has no config", id)
+	}
+	return rev, nil
+}
+
+// listRevisions returns revision metadata, newest first, without the configs.
+func listRevisions() ([]ConfigRevision, error) {
+	ids, err := revisionIDs()
+	if err != nil {
+		return nil, err
+	}
+	out := []ConfigRevision{}
+	for i := len(ids) - 1; i >= 0; i-- {
+		rev, err := loadRevision(ids[i])
+		if err != nil {
+			log.Printf("skip revision %d: %v", ids[i], err)
+			continue
+		}
+		rev.Config = nil
+		out = append(out, rev)
+	}
+	return out, nil
+}
+
+// recordRevision stores c as the next numbered revision and drops the oldest
+// ones beyond maxRevisions. Caller must hold configMutex.
+func recordRevision(c Config, author, reason string) error {
+	ids, err := revisionIDs()
+	if err != nil {
+		return err
+	}
+	next := 1
+	if len(ids) > 0 {
+		next = ids[len(ids)-1] + 1
+	}
+	rev := ConfigRevision{ID: next, Time: time.Now().UTC(), Author: author, Reason: reason, Config: &c}
+	if err := writeAtomic(revisionFile(next), mustJSON(rev), 0600); err != nil {
+		return err
+	}
+	ids = append(ids, next)
+	for len(ids) > maxRevisions {
+		_ = os.Remove(revisionFile(ids[0]))
+		ids = ids[1:]
+	}
+	return nil
+}
+
+func configDiff(nameA, nameB string, a, b Config) string {
+	return unifiedDiff(nameA, nameB, string(mustJSON(a))+"\n", string(mustJSON(b))+"\n")
+}
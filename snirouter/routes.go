@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+type httpRouteInput struct {
+	Host       string `json:"host"`
+	PathPrefix string `json:"path_prefix"`
+	Upstream   string `json:"upstream"`
+	Fallback   bool   `json:"fallback"`
+	Transport  string `json:"transport"`
+
+	Source *RouteSource `json:"-"`
+}
+
+func (in *httpRouteInput) normalize() error {
+	in.Host = strings.TrimSpace(in.Host)
+	in.PathPrefix = strings.TrimSpace(in.PathPrefix)
+	in.Upstream = strings.TrimSpace(in.Upstream)
+	in.Transport = strings.ToLower(strings.TrimSpace(in.Transport))
+	if err := validateTransport(in.Transport); err != nil {
+		return err
+	}
+	if in.Transport == transportGRPC && !in.Fallback && in.PathPrefix != "" {
+		in.PathPrefix = grpcServicePath(in.PathPrefix)
+	}
+	if in.Host == "" || in.Upstream == "" || (!in.Fallback && (in.PathPrefix == "" || !strings.HasPrefix(in.PathPrefix, "/"))) {
+		return errors.New("host/upstream (and valid path_prefix if not fallback) required")
+	}
+	return nil
+}
+
+func normalizeMapping(m *Mapping) error {
+	m.SNI = strings.TrimSpace(m.SNI)
+	m.Upstream = strings.TrimSpace(m.Upstream)
+	m.Balance = strings.TrimSpace(m.Balance)
+	m.ALPN = strings.TrimSpace(m.ALPN)
+	if m.SNI == "" || (m.Upstream == "" && !m.isGroup()) {
+		return errors.New("sni and upstream (or servers) required")
+	}
+	if err := validateSNI(m.SNI); err != nil {
+		return err
+	}
+	if err := validateALPN(m.ALPN); err != nil {
+		return err
+	}
+	if m.isGroup() {
+		m.Upstream = ""
+		return normalizeServers(m.Servers, m.Balance)
+	}
+	m.Balance = ""
+	return nil
+}
+
+// upsertMapping replaces the target of an existing SNI (case-insensitive)
+// and ALPN pair or appends a new mapping. The new Source wins, so editing an
+// x-ui route by hand makes it a manual one.
+func upsertMapping(ms *[]Mapping, m Mapping) {
+	for i := range *ms {
+		x := &(*ms)[i]
+		if strings.EqualFold(x.SNI, m.SNI) && x.ALPN == m.ALPN {
+			x.Upstream = m.Upstream
+			x.Servers = m.Servers
+			x.Balance = m.Balance
+			x.ProxyProtocol = m.ProxyProtocol
+			x.Source = m.Source
+			return
+		}
+	}
+	*ms = append(*ms, m)
+}
+
+// upsertHTTPRoute sets a host's fallback or path upstream, creating the host
+// if needed, and turns the HTTP side on.
+func upsertHTTPRoute(cfg *Config, in httpRouteInput) {
+	cfg.HTTPEnabled = true
+	for i := range cfg.HTTPHosts {
+		h := &cfg.HTTPHosts[i]
+		if !strings.EqualFold(h.Host, in.Host) {
+			continue
+		}
+		if in.Fallback {
+			h.Fallback = in.Upstream
+			return
+		}
+		for j := range h.Paths {
+			if h.Paths[j].PathPrefix == in.PathPrefix {
+				h.Paths[j].Upstream = in.Upstream
+				h.Paths[j].Transport = in.Transport
+				h.Paths[j].WebSocket = false
+				h.Paths[j].Source = in.Source
+				return
+			}
+		}
+		h.Paths = append(h.Paths, HTTPPath{PathPrefix: in.PathPrefix, Upstream: in.Upstream, Transport: in.Transport, Source: in.Source})
+		return
+	}
+	nh := HTTPHost{Host: in.Host}
+	if in.Fallback {
+		nh.Fallback = in.Upstream
+	} else {
+		nh.Paths = []HTTPPath{{PathPrefix: in.PathPrefix, Upstream: in.Upstream, Transport: in.Transport, Source: in.Source}}
+	}
+	cfg.HTTPHosts = append(cfg.HTTPHosts, nh)
+}
@@ -2,50 +2,260 @@ package main
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"os"
+	"sort"
 	"sync"
 	"time"
 )
 
+const (
+	defaultSessionTTL = 24 * time.Hour
+	sessionSweepEvery = time.Minute
+	// LastSeen is only written to disk this often per session
+	sessionSeenGrain = time.Minute
+)
+
+// session is stored under the SHA-256 of its token, so the file (or a
+// listing) never holds anything a cookie could be forged from.
+type session struct {
+	ID        string    `json:"id"` // hex SHA-256 of the token
+	User      string    `json:"user"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires"`
+	LastSeen  time.Time `json:"last_seen"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+}
+
 type sessionStore struct {
 	mu   sync.Mutex
-	data map[string]time.Time
+	data map[string]*session
+	// idle ends sessions unused for this long; 0 disables it
+	idle  time.Duration
+	dirty bool
 }
 
-func newSessionStore() *sessionStore { return &sessionStore{data: make(map[string]time.Time)} }
+func newSessionStore() *sessionStore { return &sessionStore{data: make(map[string]*session)} }
 
-func (s *sessionStore) create(ttl time.Duration) string {
+func hashToken(tok string) string {
+	sum := sha256.Sum256([]byte(tok))
+	return hex.EncodeToString(sum[:])
+}
+
+// expired reports whether ss is past its TTL or idle timeout. Caller holds
+// s.mu.
+func (s *sessionStore) expired(ss *session, now time.Time) bool {
+	return now.After(ss.Expires) || s.idle > 0 && now.Sub(ss.LastSeen) > s.idle
+}
+
+func (s *sessionStore) create(user, ip, ua string, ttl time.Duration) string {
 	b := make([]byte, 32)
 	_, _ = rand.Read(b)
 	tok := hex.EncodeToString(b)
+	now := time.Now().UTC()
+	ss := &session{ID: hashToken(tok), User: user, Created: now, Expires: now.Add(ttl), LastSeen: now, IP: ip, UserAgent: ua}
 	s.mu.Lock()
-	s.data[tok] = time.Now().Add(ttl)
+	s.data[ss.ID] = ss
+	s.saveLocked()
 	s.mu.Unlock()
 	return tok
 }
 
-func (s *sessionStore) valid(tok string) bool {
+// lookup returns the user logged in with tok and marks the session used.
+func (s *sessionStore) lookup(tok string) (string, bool) {
 	if tok == "" {
-		return false
+		return "", false
+	}
+	id := hashToken(tok)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ss, ok := s.data[id]
+	if !ok {
+		return "", false
+	}
+	now := time.Now().UTC()
+	if s.expired(ss, now) {
+		delete(s.data, id)
+		s.saveLocked()
+		return "", false
+	}
+	if now.Sub(ss.LastSeen) >= sessionSeenGrain {
+		ss.LastSeen = now
+		s.dirty = true
+	}
+	return ss.User, true
+}
+
+func (s *sessionStore) revoke(tok string) { s.revokeID(hashToken(tok)) }
+
+func (s *sessionStore) revokeID(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.data, id)
+	s.saveLocked()
+}
+
+// revokeUser ends every session of user except the one with token keep.
+func (s *sessionStore) revokeUser(user, keep string) {
+	keepID := ""
+	if keep != "" {
+		keepID = hashToken(keep)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, ss := range s.data {
+		if ss.User == user && id != keepID {
+			delete(s.data, id)
+		}
 	}
+	s.saveLocked()
+}
+
+func (s *sessionStore) get(id string) (session, bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	exp, ok := s.data[tok]
+	ss, ok := s.data[id]
 	if !ok {
-		return false
+		return session{}, false
+	}
+	return *ss, true
+}
+
+// list returns the live sessions of user, or of everyone for "", most
+// recently used first.
+func (s *sessionStore) list(user string) []session {
+	s.mu.Lock()
+	now := time.Now()
+	var out []session
+	for _, ss := range s.data {
+		if (user == "" || ss.User == user) && !s.expired(ss, now) {
+			out = append(out, *ss)
+		}
+	}
+	s.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].LastSeen.After(out[j].LastSeen) })
+	return out
+}
+
+func (s *sessionStore) setIdle(d time.Duration) {
+	s.mu.Lock()
+	s.idle = d
+	s.mu.Unlock()
+}
+
+// load reads the sessions saved by a previous run, dropping expired ones.
+func (s *sessionStore) load() error {
+	b, err := os.ReadFile(sessionsPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var doc struct {
+		Sessions []*session `json:"sessions"`
+	}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		// losing sessions only means logging in again
+		log.Printf("[sessions] discarding unreadable %s: %v", sessionsPath, err)
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for _, ss := range doc.Sessions {
+		if ss.ID != "" && !s.expired(ss, now) {
+			s.data[ss.ID] = ss
+		}
+	}
+	return nil
+}
+
+// saveLocked writes the store to disk. Caller holds s.mu.
+func (s *sessionStore) saveLocked() {
+	doc := struct {
+		Sessions []*session `json:"sessions"`
+	}{Sessions: make([]*session, 0, len(s.data))}
+	for _, ss := range s.data {
+		doc.Sessions = append(doc.Sessions, ss)
 	}
-	if time.Now().After(exp) {
-		delete(s.data, tok)
-		return false
+	if err := writeAtomic(sessionsPath, mustJSON(doc), 0600); err != nil {
+		log.Printf("[sessions] save: %v", err)
+		return
 	}
-	return true
+	s.dirty = false
 }
 
-func (s *sessionStore) revoke(tok string) { s.mu.Lock(); delete(s.data, tok); s.mu.Unlock() }
+// sweep drops expired sessions and saves pending LastSeen updates.
+func (s *sessionStore) sweep() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for id, ss := range s.data {
+		if s.expired(ss, now) {
+			delete(s.data, id)
+			s.dirty = true
+		}
+	}
+	if s.dirty {
+		s.saveLocked()
+	}
+}
+
+func (s *sessionStore) sweepLoop() {
+	for range time.Tick(sessionSweepEvery) {
+		s.sweep()
+	}
+}
 
 var sessions = newSessionStore()
 
+// sessionSettings returns the configured session lifetime and idle timeout.
+func sessionSettings(cfg Config) (ttl, idle time.Duration) {
+	ttl = defaultSessionTTL
+	if d, err := time.ParseDuration(cfg.SessionTTL); err == nil && d > 0 {
+		ttl = d
+	}
+	if d, err := time.ParseDuration(cfg.SessionIdleTimeout); err == nil && d > 0 {
+		idle = d
+	}
+	return ttl, idle
+}
+
+func validateSessionSettings(ttl, idle string) error {
+	if ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d < 5*time.Minute || d > 90*24*time.Hour {
+			return fmt.Errorf("session ttl %q must be a duration between 5m and 2160h", ttl)
+		}
+	}
+	if idle != "" {
+		d, err := time.ParseDuration(idle)
+		if err != nil || d < time.Minute {
+			return fmt.Errorf("idle timeout %q must be a duration of at least 1m", idle)
+		}
+	}
+	return nil
+}
+
+// startSession logs user in on w with the configured lifetime.
+func startSession(w http.ResponseWriter, r *http.Request, basePath, user string) {
+	configMutex.Lock()
+	cfg, _ := loadConfig()
+	configMutex.Unlock()
+	ttl, _ := sessionSettings(cfg)
+	ip := ipKey(r)[len("ip:"):]
+	tok := sessions.create(user, ip, r.UserAgent(), ttl)
+	setSessionCookie(w, basePath, tok, ttl)
+}
+
 func setSessionCookie(w http.ResponseWriter, basePath, token string, ttl time.Duration) {
 	http.SetCookie(w, &http.Cookie{
 		Name:     "sni_sess",
@@ -68,10 +278,58 @@ func clearSessionCookie(w http.ResponseWriter, basePath string) {
 	})
 }
 
-func requireSession(basePath string, h http.HandlerFunc) http.HandlerFunc {
+// The sni_2fa cookie carries a login between the password and the second
+// factor; it is only sent to the login pages.
+func setChallengeCookie(w http.ResponseWriter, basePath, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "sni_2fa",
+		Value:    token,
+		Path:     basePath + "/login",
+		MaxAge:   int(loginChallengeTTL.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearChallengeCookie(w http.ResponseWriter, basePath string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "sni_2fa",
+		Value:    "",
+		Path:     basePath + "/login",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// sessionUser returns the account behind r's session cookie.
+func sessionUser(r *http.Request) (panelUser, bool) {
+	c, _ := r.Cookie("sni_sess")
+	if c == nil {
+		return panelUser{}, false
+	}
+	name, ok := sessions.lookup(c.Value)
+	if !ok {
+		return panelUser{}, false
+	}
+	return findUser(name)
+}
+
+// sessionAuthor names the user behind r for audit records.
+func sessionAuthor(r *http.Request) string {
+	if u, ok := sessionUser(r); ok {
+		return u.Name
+	}
+	return "unknown"
+}
+
+// requireSession lets r through only with a session whose user (looked up on
+// every request, so role changes apply at once) has at least role. Endpoints
+// that also write check the higher role with requireRole.
+func requireSession(basePath, role string, h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		c, _ := r.Cookie("sni_sess")
-		if c == nil || !sessions.valid(c.Value) {
+		u, ok := sessionUser(r)
+		if !ok {
 			if len(r.URL.Path) >= len(basePath)+5 && r.URL.Path[len(basePath):len(basePath)+5] == "/api/" {
 				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 				return
@@ -79,6 +337,20 @@ func requireSession(basePath string, h http.HandlerFunc) http.HandlerFunc {
 			http.Redirect(w, r, basePath+"/login", http.StatusFound)
 			return
 		}
+		if !hasRole(u.Role, role) {
+			http.Error(w, "Forbidden: requires "+role+" role", http.StatusForbidden)
+			return
+		}
 		h(w, r)
 	}
 }
+
+// requireRole is requireSession's check inside a handler, for the writing
+// branch of an endpoint registered with a lower role.
+func requireRole(w http.ResponseWriter, r *http.Request, role string) bool {
+	if u, ok := sessionUser(r); ok && hasRole(u.Role, role) {
+		return true
+	}
+	http.Error(w, "Forbidden: requires "+role+" role", http.StatusForbidden)
+	return false
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// SNI keys follow nginx map "hostnames" semantics. Precedence when several
+// keys match one server name (decided by nginx, not by list order):
+//
+//  1. exact name            example.com
+//  2. longest leading wildcard  *.example.com / .example.com
+//  3. longest trailing wildcard www.example.*
+//  4. first matching regex, in mapping order  ~^api\d+\.example\.com$
+const (
+	sniExact    = "exact"
+	sniWildcard = "wildcard" // *.example.com, www.example.*
+	sniSuffix   = "suffix"   // .example.com = example.com + *.example.com
+	sniRegex    = "regex"
+)
+
+var reHostLabel = regexp.MustCompile(`^[a-z0-9_]([a-z0-9_-]*[a-z0-9_])?$`)
+
+func sniMatchType(sni string) string {
+	switch {
+	case strings.HasPrefix(sni, "~"):
+		return sniRegex
+	case strings.HasPrefix(sni, "*.") || strings.HasSuffix(sni, ".*"):
+		return sniWildcard
+	case strings.HasPrefix(sni, "."):
+		return sniSuffix
+	}
+	return sniExact
+}
+
+func validHostname(h string) bool {
+	if h == "" || len(h) > 253 {
+		return false
+	}
+	for _, l := range strings.Split(h, ".") {
+		if !reHostLabel.MatchString(l) {
+			return false
+		}
+	}
+	return true
+}
+
+func validateSNI(sni string) error {
+	switch sniMatchType(sni) {
+	case sniRegex:
+		expr := strings.TrimPrefix(strings.TrimPrefix(sni, "~"), "*")
+		if expr == "" || strings.ContainsAny(expr, "\"\r\n") {
+			return fmt.Errorf("invalid regex sni %q", sni)
+		}
+		if _, err := regexp.Compile(expr); err != nil {
+			return fmt.Errorf("invalid regex sni %q: %v", sni, err)
+		}
+		return nil
+	case sniWildcard:
+		h := strings.TrimSuffix(strings.TrimPrefix(sni, "*."), ".*")
+		if strings.HasPrefix(sni, "*.") && strings.HasSuffix(sni, ".*") || !validHostname(strings.ToLower(h)) {
+			return fmt.Errorf("invalid wildcard sni %q", sni)
+		}
+	case sniSuffix:
+		if !validHostname(strings.ToLower(sni[1:])) {
+			return fmt.Errorf("invalid sni %q", sni)
+		}
+	default:
+		if !validHostname(strings.ToLower(sni)) {
+			return fmt.Errorf("invalid sni %q", sni)
+		}
+	}
+	return nil
+}
+
+// sniHashKeys returns the nginx hash entries a key occupies; ".x" expands to
+// both "x" and "*.x". Regexes occupy none.
+func sniHashKeys(sni string) []string {
+	k := strings.ToLower(sni)
+	switch sniMatchType(k) {
+	case sniRegex:
+		return nil
+	case sniSuffix:
+		return []string{k[1:], "*" + k}
+	}
+	return []string{k}
+}
+
+// sniConflict reports an existing mapping that nginx would reject next to
+// sni (e.g. ".example.com" together with "*.example.com"). Mappings with the
+// same key are updates, not conflicts.
+func sniConflict(ms []Mapping, sni string) (string, bool) {
+	want := map[string]bool{}
+	for _, k := range sniHashKeys(sni) {
+		want[k] = true
+	}
+	for _, m := range ms {
+		if strings.EqualFold(m.SNI, sni) {
+			continue
+		}
+		for _, k := range sniHashKeys(m.SNI) {
+			if want[k] {
+				return m.SNI, true
+			}
+		}
+	}
+	return "", false
+}
+
+// mapKey renders a key for the map block; regexes are quoted.
+func mapKey(sni string) string {
+	if sniMatchType(sni) == sniRegex {
+		return `"` + sni + `"`
+	}
+	return strings.ToLower(sni)
+}
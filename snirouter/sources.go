@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// inboundSource is somewhere proxy inbounds can be imported from. Every
+// source yields XUICandidates so scan, apply and prune work the same for all.
+type inboundSource interface {
+	Name() string
+	DefaultPath() string
+	Scan(path string) ([]XUICandidate, error)
+}
+
+type xuiSource struct{}
+
+func (xuiSource) Name() string                             { return sourceXUI }
+func (xuiSource) DefaultPath() string                      { return xuiDBPath }
+func (xuiSource) Scan(path string) ([]XUICandidate, error) { return scanXUI(path) }
+
+// xrayJSONSource reads a plain Xray config (or a -confdir directory of them).
+// Marzban keeps the same format in its own file.
+type xrayJSONSource struct{ name, path string }
+
+func (s xrayJSONSource) Name() string        { return s.name }
+func (s xrayJSONSource) DefaultPath() string { return s.path }
+func (s xrayJSONSource) Scan(path string) ([]XUICandidate, error) {
+	var ins []xuiInbound
+	err := forEachJSONFile(path, func(data []byte) error {
+		var doc struct {
+			Inbounds []struct {
+				Tag            string          `json:"tag"`
+				Listen         string          `json:"listen"`
+				Port           json.RawMessage `json:"port"`
+				Protocol       string          `json:"protocol"`
+				StreamSettings json.RawMessage `json:"streamSettings"`
+			} `json:"inbounds"`
+		}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return err
+		}
+		for _, in := range doc.Inbounds {
+			port, ok := xrayPort(in.Port)
+			if !ok && !strings.HasPrefix(in.Listen, "/") {
+				continue // port ranges and env placeholders have no single upstream
+			}
+			ins = append(ins, xuiInbound{Remark: in.Tag, Port: port, Listen: in.Listen, Enable: true,
+				Protocol: in.Protocol, StreamSettings: string(in.StreamSettings)})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return candidatesFromInbounds(ins), nil
+}
+
+// xrayPort accepts Xray's numeric or string port; ranges are rejected.
+func xrayPort(raw json.RawMessage) (int, bool) {
+	var n int
+	if json.Unmarshal(raw, &n) == nil {
+		return n, n > 0 && n <= 65535
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		if n, err := strconv.Atoi(strings.TrimSpace(s)); err == nil {
+			return n, n > 0 && n <= 65535
+		}
+	}
+	return 0, false
+}
+
+type singBoxSource struct{}
+
+func (singBoxSource) Name() string        { return "sing-box" }
+func (singBoxSource) DefaultPath() string { return "/etc/sing-box/config.json" }
+func (singBoxSource) Scan(path string) ([]XUICandidate, error) {
+	var out []XUICandidate
+	err := forEachJSONFile(path, func(data []byte) error {
+		var doc struct {
+			Inbounds []singBoxInbound `json:"inbounds"`
+		}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return err
+		}
+		for _, in := range doc.Inbounds {
+			base := XUICandidate{Remark: in.Tag, Port: in.ListenPort, Listen: in.Listen}
+			out = append(out, streamCandidates(base, in.stream())...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dedupCandidates(out), nil
+}
+
+type singBoxInbound struct {
+	Type          string `json:"type"`
+	Tag           string `json:"tag"`
+	Listen        string `json:"listen"`
+	ListenPort    int    `json:"listen_port"`
+	ProxyProtocol bool   `json:"proxy_protocol"`
+	TLS           struct {
+		Enabled    bool   `json:"enabled"`
+		ServerName string `json:"server_name"`
+		Reality    struct {
+			Enabled bool `json:"enabled"`
+		} `json:"reality"`
+	} `json:"tls"`
+	Transport struct {
+		Type        string                     `json:"type"`
+		Host        json.RawMessage            `json:"host"`
+		Path        string                     `json:"path"`
+		ServiceName string                     `json:"service_name"`
+		Headers     map[string]json.RawMessage `json:"headers"`
+	} `json:"transport"`
+}
+
+// stream maps a sing-box inbound onto the Xray stream settings shape.
+func (in singBoxInbound) stream() xuiStream {
+	var st xuiStream
+	st.Sockopt.AcceptProxyProtocol = in.ProxyProtocol
+	if in.TLS.Enabled {
+		if in.TLS.Reality.Enabled {
+			st.Security = "reality"
+			st.RealitySettings.ServerNames = []string{in.TLS.ServerName}
+		} else {
+			st.Security = "tls"
+			st.TLSSettings.ServerName = in.TLS.ServerName
+		}
+	}
+
+	t := in.Transport
+	host := pickFirstString(string(t.Host))
+	for k, v := range t.Headers {
+		if host == "" && strings.EqualFold(k, "host") {
+			host = pickFirstString(string(v))
+		}
+	}
+	st.Network = t.Type
+	switch t.Type {
+	case "":
+		st.Network = "tcp"
+	case "ws":
+		st.WSSettings.Path, st.WSSettings.Host = t.Path, host
+	case "http":
+		st.HTTPSettings.Path = t.Path
+		if host != "" {
+			st.HTTPSettings.Host = []string{host}
+		}
+	case transportGRPC:
+		st.GRPCSettings.ServiceName = t.ServiceName
+	case transportHTTPUpgrade:
+		st.HTTPUpgradeSettings.Path, st.HTTPUpgradeSettings.Host = t.Path, host
+	}
+	return st
+}
+
+var inboundSources = []inboundSource{
+	xuiSource{},
+	xrayJSONSource{name: "xray", path: "/usr/local/etc/xray/config.json"},
+	xrayJSONSource{name: "marzban", path: "/var/lib/marzban/xray_config.json"},
+	singBoxSource{},
+}
+
+// findInboundSource looks a source up by name; "" is x-ui.
+func findInboundSource(name string) (inboundSource, error) {
+	if name == "" {
+		name = sourceXUI
+	}
+	for _, s := range inboundSources {
+		if s.Name() == name {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown inbound source %q", name)
+}
+
+// scanSource scans src at path (its default when empty), tagging and
+// numbering the results.
+func scanSource(src inboundSource, path string) ([]XUICandidate, error) {
+	if path == "" {
+		path = src.DefaultPath()
+	}
+	items, err := src.Scan(path)
+	if err != nil {
+		return nil, err
+	}
+	for i := range items {
+		items[i].Source = src.Name()
+	}
+	return withCandidateIDs(items), nil
+}
+
+func sourcePresent(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// maxSourceSize caps how much of one source file is read; x-ui databases
+// with thousands of clients stay far below it.
+const maxSourceSize = 64 << 20
+
+// readSourceFile reads path, refusing anything but a regular file of at most
+// maxSourceSize bytes (the path may come from the request).
+func readSourceFile(path string) ([]byte, error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !st.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", path)
+	}
+	tooBig := fmt.Errorf("%s is larger than %d MiB", path, maxSourceSize>>20)
+	if st.Size() > maxSourceSize {
+		return nil, tooBig
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, maxSourceSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxSourceSize {
+		return nil, tooBig
+	}
+	return data, nil
+}
+
+// forEachJSONFile calls fn with path's contents or, for a directory, with
+// every *.json in it in name order (Xray's -confdir layout). Comments are
+// stripped first since Xray accepts them.
+func forEachJSONFile(path string, fn func([]byte) error) error {
+	files := []string{path}
+	if st, err := os.Stat(path); err != nil {
+		return err
+	} else if st.IsDir() {
+		files, _ = filepath.Glob(filepath.Join(path, "*.json"))
+		sort.Strings(files)
+	}
+	for _, f := range files {
+		data, err := readSourceFile(f)
+		if err != nil {
+			return err
+		}
+		if err := fn(stripJSONComments(data)); err != nil {
+			return fmt.Errorf("%s: %v", f, err)
+		}
+	}
+	return nil
+}
+
+func stripJSONComments(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	inStr, esc := false, false
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if inStr {
+			out = append(out, c)
+			switch {
+			case esc:
+				esc = false
+			case c == '\\':
+				esc = true
+			case c == '"':
+				inStr = false
+			}
+			continue
+		}
+		switch {
+		case c == '"':
+			inStr = true
+		case c == '/' && i+1 < len(data) && data[i+1] == '/':
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+		case c == '/' && i+1 < len(data) && data[i+1] == '*':
+			i += 2
+			for i+1 < len(data) && !(data[i] == '*' && data[i+1] == '/') {
+				i++
+			}
+			i++
+			continue
+		}
+		if i < len(data) {
+			out = append(out, data[i])
+		}
+	}
+	return out
+}
+
+// pathSignature changes whenever the source file (or, for x-ui, its WAL, or
+// any file of a config directory) is written.
+func pathSignature(path string) string {
+	paths := []string{path, path + "-wal"}
+	if st, err := os.Stat(path); err == nil && st.IsDir() {
+		entries, _ := filepath.Glob(filepath.Join(path, "*"))
+		sort.Strings(entries)
+		paths = append(paths, entries...)
+	}
+	var sig strings.Builder
+	for _, p := range paths {
+		if st, err := os.Stat(p); err == nil {
+			fmt.Fprintf(&sig, "%d:%d;", st.ModTime().UnixNano(), st.Size())
+		} else {
+			sig.WriteString("-;")
+		}
+	}
+	return sig.String()
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+)
+
+// A minimal read-only SQLite 3 reader: enough of the file format to list the
+// rows of an ordinary rowid table. Committed frames of a -wal file are
+// overlaid on the main file so a database in WAL mode reads current data.
+// See https://www.sqlite.org/fileformat2.html.
+
+const sqliteMagic = "SQLite format 3\x00"
+
+type sqliteDB struct {
+	data     []byte
+	pageSize int
+	usable   int
+	wal      map[uint32][]byte
+	nPages   uint32
+}
+
+// sqliteRow holds one record; values are nil, int64, float64, string or []byte.
+type sqliteRow map[string]interface{}
+
+func openSQLite(path string) (*sqliteDB, error) {
+	data, err := readSourceFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 100 || string(data[:16]) != sqliteMagic {
+		return nil, errors.New("sqlite: not a database file")
+	}
+	db := &sqliteDB{data: data}
+	db.pageSize = int(binary.BigEndian.Uint16(data[16:18]))
+	if db.pageSize == 1 {
+		db.pageSize = 65536
+	}
+	if db.pageSize < 512 || db.pageSize&(db.pageSize-1) != 0 {
+		return nil, fmt.Errorf("sqlite: bad page size %d", db.pageSize)
+	}
+	db.usable = db.pageSize - int(data[20])
+	if db.usable < 480 { // the minimum the format allows
+		return nil, fmt.Errorf("sqlite: bad reserved space %d", data[20])
+	}
+	if enc := binary.BigEndian.Uint32(data[56:60]); enc > 1 {
+		return nil, fmt.Errorf("sqlite: unsupported text encoding %d", enc)
+	}
+	db.nPages = uint32(len(data) / db.pageSize)
+
+	if wal, err := readSourceFile(path + "-wal"); err == nil {
+		if err := db.loadWAL(wal); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return db, nil
+}
+
+// loadWAL keeps the latest copy of every page written by a committed
+// transaction in the current WAL generation.
+func (db *sqliteDB) loadWAL(wal []byte) error {
+	if len(wal) < 32 {
+		return nil
+	}
+	magic := binary.BigEndian.Uint32(wal[0:4])
+	var order binary.ByteOrder
+	switch magic {
+	case 0x377f0682:
+		order = binary.LittleEndian
+	case 0x377f0683:
+		order = binary.BigEndian
+	default:
+		return nil
+	}
+	if int(binary.BigEndian.Uint32(wal[8:12])) != db.pageSize {
+		return errors.New("sqlite: wal page size mismatch")
+	}
+	salt1, salt2 := binary.BigEndian.Uint32(wal[16:20]), binary.BigEndian.Uint32(wal[20:24])
+	s1, s2 := walChecksum(order, wal[0:24], 0, 0)
+	if s1 != binary.BigEndian.Uint32(wal[24:28]) || s2 != binary.BigEndian.Uint32(wal[28:32]) {
+		return nil
+	}
+
+	committed := map[uint32][]byte{}
+	pending := map[uint32][]byte{}
+	frame := 24 + db.pageSize
+	for off := 32; off+frame <= len(wal); off += frame {
+		hdr := wal[off : off+24]
+		if binary.BigEndian.Uint32(hdr[8:12]) != salt1 || binary.BigEndian.Uint32(hdr[12:16]) != salt2 {
+			break
+		}
+		s1, s2 = walChecksum(order, hdr[0:8], s1, s2)
+		s1, s2 = walChecksum(order, wal[off+24:off+frame], s1, s2)
+		if s1 != binary.BigEndian.Uint32(hdr[16:20]) || s2 != binary.BigEndian.Uint32(hdr[20:24]) {
+			break
+		}
+		pending[binary.BigEndian.Uint32(hdr[0:4])] = wal[off+24 : off+frame]
+		if size := binary.BigEndian.Uint32(hdr[4:8]); size != 0 {
+			for pg, b := range pending {
+				committed[pg] = b
+			}
+			pending = map[uint32][]byte{}
+			// every page past the end of the main file is in the WAL
+			db.nPages = min(size, uint32(len(db.data)/db.pageSize+len(committed)))
+		}
+	}
+	db.wal = committed
+	return nil
+}
+
+func walChecksum(order binary.ByteOrder, b []byte, s1, s2 uint32) (uint32, uint32) {
+	for i := 0; i+8 <= len(b); i += 8 {
+		s1 += order.Uint32(b[i:]) + s2
+		s2 += order.Uint32(b[i+4:]) + s1
+	}
+	return s1, s2
+}
+
+func (db *sqliteDB) page(n uint32) ([]byte, error) {
+	if n == 0 || n > db.nPages {
+		return nil, fmt.Errorf("sqlite: page %d out of range", n)
+	}
+	if p, ok := db.wal[n]; ok {
+		return p, nil
+	}
+	off := int(n-1) * db.pageSize
+	if off+db.pageSize > len(db.data) {
+		return nil, fmt.Errorf("sqlite: page %d out of range", n)
+	}
+	return db.data[off : off+db.pageSize], nil
+}
+
+// walkTable calls fn with the rowid and payload of every cell in the table
+// b-tree rooted at root.
+func (db *sqliteDB) walkTable(root uint32, fn func(rowid int64, payload []byte) error) error {
+	seen := map[uint32]bool{}
+	var walk func(n uint32) error
+	walk = func(n uint32) error {
+		if seen[n] {
+			return fmt.Errorf("sqlite: b-tree loop at page %d", n)
+		}
+		seen[n] = true
+		p, err := db.page(n)
+		if err != nil {
+			return err
+		}
+		hdr := 0
+		if n == 1 {
+			hdr = 100
+		}
+		if hdr+8 > len(p) {
+			return fmt.Errorf("sqlite: short page %d", n)
+		}
+		kind := p[hdr]
+		if kind != 0x05 && kind != 0x0d {
+			return fmt.Errorf("sqlite: page %d is not a table b-tree page (0x%02x)", n, kind)
+		}
+		ncells := int(binary.BigEndian.Uint16(p[hdr+3:]))
+		ptrs := hdr + 8
+		if kind == 0x05 {
+			ptrs = hdr + 12
+		}
+		if ptrs+2*ncells > len(p) {
+			return fmt.Errorf("sqlite: bad cell count on page %d", n)
+		}
+		for i := 0; i < ncells; i++ {
+			off := int(binary.BigEndian.Uint16(p[ptrs+2*i:]))
+			if off >= len(p) {
+				return fmt.Errorf("sqlite: bad cell offset on page %d", n)
+			}
+			switch kind {
+			case 0x05: // interior table
+				if off+4 > len(p) {
+					return fmt.Errorf("sqlite: bad cell on page %d", n)
+				}
+				if err := walk(binary.BigEndian.Uint32(p[off:])); err != nil {
+					return err
+				}
+			case 0x0d: // leaf table
+				size, k := readVarint(p[off:])
+				rowid, k2 := readVarint(p[off+k:])
+				if k == 0 || k2 == 0 || size > uint64(db.nPages)*uint64(db.pageSize) {
+					return fmt.Errorf("sqlite: bad cell on page %d", n)
+				}
+				payload, err := db.payload(p, off+k+k2, int(size))
+				if err != nil {
+					return err
+				}
+				if err := fn(int64(rowid), payload); err != nil {
+					return err
+				}
+			}
+		}
+		if kind == 0x05 {
+			return walk(binary.BigEndian.Uint32(p[hdr+8:]))
+		}
+		return nil
+	}
+	return walk(root)
+}
+
+// payload assembles a leaf cell's payload, following the overflow chain when
+// it does not fit on the page.
+func (db *sqliteDB) payload(p []byte, off, size int) ([]byte, error) {
+	if size < 0 || size > int(db.nPages)*db.pageSize {
+		return nil, errors.New("sqlite: bad payload size")
+	}
+	u := db.usable
+	local := size
+	if maxLocal := u - 35; size > maxLocal {
+		minLocal := (u-12)*32/255 - 23
+		local = minLocal + (size-minLocal)%(u-4)
+		if local > maxLocal {
+			local = minLocal
+		}
+	}
+	if off+local > len(p) {
+		return nil, errors.New("sqlite: cell overruns page")
+	}
+	out := make([]byte, 0, size)
+	out = append(out, p[off:off+local]...)
+	if local == size {
+		return out, nil
+	}
+	if off+local+4 > len(p) {
+		return nil, errors.New("sqlite: cell overruns page")
+	}
+	next := binary.BigEndian.Uint32(p[off+local:])
+	for hops := 0; len(out) < size; hops++ {
+		if next == 0 || hops > int(db.nPages) {
+			return nil, errors.New("sqlite: broken overflow chain")
+		}
+		op, err := db.page(next)
+		if err != nil {
+			return nil, err
+		}
+		n := size - len(out)
+		if n > u-4 {
+			n = u - 4
+		}
+		out = append(out, op[4:4+n]...)
+		next = binary.BigEndian.Uint32(op[0:4])
+	}
+	return out, nil
+}
+
+// readVarint decodes a SQLite varint, returning the value and its length
+// (0 if b is too short).
+func readVarint(b []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < 9; i++ {
+		if i >= len(b) {
+			return 0, 0
+		}
+		if i == 8 {
+			return v<<8 | uint64(b[i]), 9
+		}
+		v = v<<7 | uint64(b[i]&0x7f)
+		if b[i] < 0x80 {
+			return v, i + 1
+		}
+	}
+	return v, 9
+}
+
+// decodeRecord splits a record into its column values.
+func decodeRecord(rec []byte) ([]interface{}, error) {
+	hlen, k := readVarint(rec)
+	if k == 0 || hlen < uint64(k) || hlen > uint64(len(rec)) {
+		return nil, errors.New("sqlite: bad record header")
+	}
+	var types []uint64
+	for pos := k; pos < int(hlen); {
+		t, n := readVarint(rec[pos:int(hlen)])
+		if n == 0 {
+			return nil, errors.New("sqlite: bad record header")
+		}
+		types = append(types, t)
+		pos += n
+	}
+
+	vals := make([]interface{}, 0, len(types))
+	body := rec[hlen:]
+	for _, t := range types {
+		var n int
+		switch {
+		case t == 0, t == 8, t == 9:
+			n = 0
+		case t <= 4:
+			n = int(t)
+		case t == 5:
+			n = 6
+		case t == 6, t == 7:
+			n = 8
+		case t >= 12:
+			if (t-12)/2 > uint64(len(body)) {
+				return nil, errors.New("sqlite: record overruns payload")
+			}
+			n = int((t - 12) / 2)
+		default:
+			return nil, fmt.Errorf("sqlite: bad serial type %d", t)
+		}
+		if n > len(body) {
+			return nil, errors.New("sqlite: record overruns payload")
+		}
+		b := body[:n]
+		body = body[n:]
+
+		switch {
+		case t == 0:
+			vals = append(vals, nil)
+		case t == 8:
+			vals = append(vals, int64(0))
+		case t == 9:
+			vals = append(vals, int64(1))
+		case t <= 6:
+			v := int64(int8(b[0]))
+			for _, c := range b[1:] {
+				v = v<<8 | int64(c)
+			}
+			vals = append(vals, v)
+		case t == 7:
+			vals = append(vals, math.Float64frombits(binary.BigEndian.Uint64(b)))
+		case t%2 == 0:
+			vals = append(vals, append([]byte(nil), b...))
+		default:
+			vals = append(vals, string(b))
+		}
+	}
+	return vals, nil
+}
+
+// readTable returns every row of the named table keyed by column name. The
+// INTEGER PRIMARY KEY column, which SQLite stores as the rowid, is filled in
+// from it.
+func (db *sqliteDB) readTable(name string) ([]sqliteRow, error) {
+	var root uint32
+	var createSQL string
+	err := db.walkTable(1, func(_ int64, payload []byte) error {
+		v, err := decodeRecord(payload)
+		if err != nil || len(v) < 5 {
+			return err
+		}
+		if typ, _ := v[0].(string); typ != "table" {
+			return nil
+		}
+		if n, _ := v[1].(string); !strings.EqualFold(n, name) {
+			return nil
+		}
+		rp, _ := v[3].(int64)
+		root = uint32(rp)
+		createSQL, _ = v[4].(string)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if root == 0 {
+		return nil, fmt.Errorf("sqlite: no table %q", name)
+	}
+	cols, rowidCol := parseCreateTable(createSQL)
+	if len(cols) == 0 {
+		return nil, fmt.Errorf("sqlite: cannot parse schema of %q", name)
+	}
+
+	var rows []sqliteRow
+	err = db.walkTable(root, func(rowid int64, payload []byte) error {
+		v, err := decodeRecord(payload)
+		if err != nil {
+			return err
+		}
+		row := sqliteRow{}
+		for i, c := range cols {
+			if i < len(v) {
+				row[c] = v[i]
+			} else {
+				row[c] = nil // column added by ALTER TABLE after the row was written
+			}
+		}
+		if rowidCol != "" && row[rowidCol] == nil {
+			row[rowidCol] = rowid
+		}
+		rows = append(rows, row)
+		return nil
+	})
+	return rows, err
+}
+
+// parseCreateTable extracts column names from a CREATE TABLE statement and
+// reports which one, if any, aliases the rowid.
+func parseCreateTable(sql string) ([]string, string) {
+	open, end := strings.Index(sql, "("), strings.LastIndex(sql, ")")
+	if open < 0 || end <= open {
+		return nil, ""
+	}
+	var defs []string
+	depth, start := 0, open+1
+	var quote byte
+	for i := open + 1; i < end; i++ {
+		c := sql[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '`' || c == '\'':
+			quote = c
+		case c == '[':
+			quote = ']'
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			defs = append(defs, sql[start:i])
+			start = i + 1
+		}
+	}
+	defs = append(defs, sql[start:end])
+
+	var cols []string
+	types := map[string]string{}
+	pk := ""
+	for _, d := range defs {
+		d = strings.TrimSpace(d)
+		up := strings.ToUpper(d)
+		if strings.HasPrefix(up, "PRIMARY KEY") {
+			l, r := strings.Index(d, "("), strings.Index(d, ")")
+			if l >= 0 && r > l {
+				keys := strings.Split(d[l+1:r], ",")
+				if len(keys) == 1 && !strings.Contains(strings.ToUpper(keys[0]), "DESC") {
+					pk = unquoteIdent(keys[0])
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(up, "CONSTRAINT") || strings.HasPrefix(up, "UNIQUE") ||
+			strings.HasPrefix(up, "CHECK") || strings.HasPrefix(up, "FOREIGN KEY") {
+			continue
+		}
+		name, rest := splitIdent(d)
+		if name == "" {
+			continue
+		}
+		cols = append(cols, name)
+		fields := strings.Fields(strings.ToUpper(rest))
+		if len(fields) > 0 {
+			types[name] = fields[0]
+		}
+		if strings.Contains(strings.ToUpper(rest), "PRIMARY KEY") && !strings.Contains(strings.ToUpper(rest), "DESC") {
+			pk = name
+		}
+	}
+	if pk != "" && types[pk] == "INTEGER" {
+		return cols, pk
+	}
+	return cols, ""
+}
+
+// splitIdent splits a column definition into its (unquoted) name and the rest.
+func splitIdent(d string) (string, string) {
+	if d == "" {
+		return "", ""
+	}
+	closer := map[byte]byte{'"': '"', '`': '`', '[': ']', '\'': '\''}[d[0]]
+	if closer != 0 {
+		if i := strings.IndexByte(d[1:], closer); i >= 0 {
+			return d[1 : 1+i], d[2+i:]
+		}
+		return "", ""
+	}
+	if i := strings.IndexAny(d, " \t\r\n"); i >= 0 {
+		return d[:i], d[i:]
+	}
+	return d, ""
+}
+
+func unquoteIdent(s string) string {
+	name, _ := splitIdent(strings.TrimSpace(s))
+	return name
+}
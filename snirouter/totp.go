@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RFC 6238 parameters every authenticator app assumes.
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// codes from one step either side are accepted for clock drift
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+
+	// how long and how many tries the second login step gets
+	loginChallengeTTL   = 5 * time.Minute
+	loginChallengeTries = 5
+)
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func newTOTPSecret() string {
+	b := make([]byte, 20)
+	_, _ = rand.Read(b)
+	return b32.EncodeToString(b)
+}
+
+// totpURI is the otpauth:// URI authenticator apps import (usually as a QR
+// code).
+func totpURI(secret, user, issuer string) string {
+	label := url.PathEscape(issuer + ":" + user)
+	q := url.Values{"secret": {secret}, "issuer": {issuer}, "algorithm": {"SHA1"},
+		"digits": {fmt.Sprint(totpDigits)}, "period": {fmt.Sprint(totpPeriod)}}
+	// some apps show a "+" from form encoding literally
+	return "otpauth://totp/" + label + "?" + strings.ReplaceAll(q.Encode(), "+", "%20")
+}
+
+func totpCode(secret string, step int64) (string, error) {
+	key, err := b32.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	m := hmac.New(sha1.New, key)
+	m.Write(msg[:])
+	sum := m.Sum(nil)
+	off := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, n%1_000_000), nil
+}
+
+// verifyTOTP checks code against the steps around now and returns the step
+// it matched. Steps at or before last were already used and are refused.
+func verifyTOTP(secret, code string, now time.Time, last int64) (int64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	cur := now.Unix() / totpPeriod
+	for step := cur - totpSkew; step <= cur+totpSkew; step++ {
+		want, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if step > last && subtle.ConstantTimeCompare([]byte(want), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// newRecoveryCodes returns codes to show once and the hashes to store.
+func newRecoveryCodes() (codes, hashes []string) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		_, _ = rand.Read(b)
+		c := strings.ToLower(b32.EncodeToString(b))
+		c = c[:4] + "-" + c[4:]
+		codes = append(codes, c)
+		hashes = append(hashes, hashRecoveryCode(c))
+	}
+	return codes, hashes
+}
+
+// Recovery codes are random enough that a plain SHA-256 is sufficient.
+func hashRecoveryCode(c string) string {
+	c = strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(strings.TrimSpace(c)))
+	sum := sha256.Sum256([]byte(c))
+	return hex.EncodeToString(sum[:])
+}
+
+// loginChallenge is a login that passed the password check and waits for
+// its second factor.
+type loginChallenge struct {
+	User    string
+	Expires time.Time
+	Tries   int
+}
+
+type challengeStore struct {
+	mu   sync.Mutex
+	data map[string]*loginChallenge
+}
+
+var challenges = &challengeStore{data: make(map[string]*loginChallenge)}
+
+func (s *challengeStore) create(user string) string {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+	tok := hex.EncodeToString(b)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for t, c := range s.data {
+		if time.Now().After(c.Expires) {
+			delete(s.data, t)
+		}
+	}
+	s.data[tok] = &loginChallenge{User: user, Expires: time.Now().Add(loginChallengeTTL)}
+	return tok
+}
+
+// attempt returns the user waiting on tok, counting the try; the challenge
+// is dropped once expired or out of tries.
+func (s *challengeStore) attempt(tok string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.data[tok]
+	if !ok {
+		return "", false
+	}
+	c.Tries++
+	if time.Now().After(c.Expires) || c.Tries > loginChallengeTries {
+		delete(s.data, tok)
+		return "", false
+	}
+	return c.User, true
+}
+
+func (s *challengeStore) done(tok string) { s.mu.Lock(); delete(s.data, tok); s.mu.Unlock() }
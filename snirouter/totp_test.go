@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// RFC 6238 appendix B, SHA-1: the key is the ASCII string
+// "12345678901234567890"; the RFC lists 8 digits, we use the last 6.
+var rfc6238Secret = b32.EncodeToString([]byte("12345678901234567890"))
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		got, err := totpCode(rfc6238Secret, tt.unix/totpPeriod)
+		if err != nil || got != tt.want {
+			t.Errorf("T=%d: totpCode = %q, %v; want %q", tt.unix, got, err, tt.want)
+		}
+		if _, ok := verifyTOTP(rfc6238Secret, tt.want, time.Unix(tt.unix, 0), 0); !ok {
+			t.Errorf("T=%d: verifyTOTP rejected %s", tt.unix, tt.want)
+		}
+	}
+	// secrets typed in lower case
+	if got, _ := totpCode(strings.ToLower(rfc6238Secret), 1); got != "287082" {
+		t.Errorf("lower-case secret gave %q", got)
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	cur := now.Unix() / totpPeriod
+	code := func(step int64) string {
+		c, err := totpCode(rfc6238Secret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	tests := []struct {
+		name string
+		code string
+		last int64
+		ok   bool
+		step int64
+	}{
+		{"current step", code(cur), 0, true, cur},
+		{"previous step", code(cur - 1), 0, true, cur - 1},
+		{"next step", code(cur + 1), 0, true, cur + 1},
+		{"two steps old", code(cur - 2), 0, false, 0},
+		{"two steps ahead", code(cur + 2), 0, false, 0},
+		{"spaces are ignored", code(cur)[:3] + " " + code(cur)[3:], 0, true, cur},
+		{"replayed", code(cur), cur, false, 0},
+		{"older than the last used", code(cur - 1), cur - 1, false, 0},
+		{"newer than the last used", code(cur + 1), cur, true, cur + 1},
+		{"too short", code(cur)[:5], 0, false, 0},
+		{"too long", code(cur) + "0", 0, false, 0},
+		{"empty", "", 0, false, 0},
+	}
+	for _, tt := range tests {
+		step, ok := verifyTOTP(rfc6238Secret, tt.code, now, tt.last)
+		if ok != tt.ok || step != tt.step {
+			t.Errorf("%s: verifyTOTP(%q, last=%d) = %d, %v; want %d, %v", tt.name, tt.code, tt.last, step, ok, tt.step, tt.ok)
+		}
+	}
+	if _, ok := verifyTOTP("not base32!", "123456", now, 0); ok {
+		t.Error("accepted a code for an invalid secret")
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes := newRecoveryCodes()
+	if len(codes) != recoveryCodeCount || len(hashes) != recoveryCodeCount {
+		t.Fatalf("got %d codes, %d hashes", len(codes), len(hashes))
+	}
+	c := codes[0]
+	for _, typed := range []string{c, strings.ToUpper(c), strings.ReplaceAll(c, "-", ""), " " + c + " "} {
+		if hashRecoveryCode(typed) != hashes[0] {
+			t.Errorf("%q does not match the stored hash of %q", typed, c)
+		}
+	}
+	if hashRecoveryCode(codes[1]) == hashes[0] {
+		t.Error("two codes share a hash")
+	}
+}
+
+func TestChallengeTries(t *testing.T) {
+	s := &challengeStore{data: map[string]*loginChallenge{}}
+	tok := s.create("alice")
+	for i := 0; i < loginChallengeTries; i++ {
+		if u, ok := s.attempt(tok); !ok || u != "alice" {
+			t.Fatalf("try %d refused", i+1)
+		}
+	}
+	if _, ok := s.attempt(tok); ok {
+		t.Error("challenge allowed more than loginChallengeTries tries")
+	}
+
+	tok = s.create("bob")
+	s.data[tok].Expires = time.Now().Add(-time.Second)
+	if _, ok := s.attempt(tok); ok {
+		t.Error("expired challenge accepted")
+	}
+	if _, ok := s.attempt("unknown"); ok {
+		t.Error("unknown token accepted")
+	}
+}
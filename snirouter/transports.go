@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// HTTP path transports, named after the Xray streamSettings network they
+// front. The empty value is a plain HTTP proxy (tcp header emulation, h2c).
+const (
+	transportHTTP        = ""
+	transportWS          = "ws"
+	transportGRPC        = "grpc"
+	transportHTTPUpgrade = "httpupgrade"
+	transportSplitHTTP   = "splithttp"
+	transportXHTTP       = "xhttp"
+
+	// h2c port for gRPC paths unless Config.GRPCPort is set
+	defaultGRPCPort = 50051
+)
+
+func validateTransport(t string) error {
+	switch t {
+	case transportHTTP, transportWS, transportGRPC, transportHTTPUpgrade, transportSplitHTTP, transportXHTTP:
+		return nil
+	}
+	return fmt.Errorf("unknown transport %q", t)
+}
+
+// transport returns the path's transport, honouring the websocket flag of
+// configs written before Transport existed.
+func (p HTTPPath) transport() string {
+	if p.Transport == transportHTTP && p.WebSocket {
+		return transportWS
+	}
+	return p.Transport
+}
+
+// grpcServicePath turns a gRPC serviceName into the location prefix its calls
+// arrive on (/<name>/Tun, /<name>/TunMulti). Names that already start with a
+// slash are Xray's custom-path form and are used as-is.
+func grpcServicePath(name string) string {
+	name = strings.TrimSpace(name)
+	if strings.HasPrefix(name, "/") {
+		return name
+	}
+	return "/" + strings.Trim(name, "/") + "/"
+}
+
+// splitHTTPProxyCommon is baseProxyCommon with buffering off in both
+// directions so SplitHTTP/XHTTP streamed responses and uploads are not held
+// back by nginx.
+func splitHTTPProxyCommon() string {
+	return baseProxyCommon() + `    proxy_buffering off;
+    proxy_request_buffering off;
+    client_max_body_size 0;
+    proxy_read_timeout 1h;
+    proxy_send_timeout 1h;
+`
+}
+
+func grpcLocation(prefix, up string) string {
+	return fmt.Sprintf(`    location ^~ %s {
+        grpc_pass grpc://%s;
+        grpc_set_header Host $host;
+        grpc_set_header X-Real-IP $remote_addr;
+        grpc_read_timeout 1h;
+        grpc_send_timeout 1h;
+        client_max_body_size 0;
+    }
+
+`, prefix, up)
+}
+
+// pathLocation renders the location block for one HTTP path.
+func pathLocation(prefix, up, transport string) string {
+	if transport == transportGRPC {
+		return grpcLocation(prefix, up)
+	}
+	pc := baseProxyCommon()
+	switch transport {
+	case transportWS, transportHTTPUpgrade:
+		pc = websocketProxyCommon()
+	case transportSplitHTTP, transportXHTTP:
+		pc = splitHTTPProxyCommon()
+	}
+	return fmt.Sprintf("    location ^~ %s {\n        proxy_pass http://%s;%s    }\n\n", prefix, up, pc)
+}
+
+// grpcServerBlock serves host's gRPC paths on their own h2c (HTTP/2 without
+// TLS) port. gRPC clients need h2c, and on a plain port that can only be
+// switched on per address:port, never per server_name, so it cannot share
+// :80 with HTTP/1.1 hosts. "listen ... http2" is used rather than "http2 on"
+// since the latter needs nginx 1.25.1, newer than the Debian/Ubuntu packages.
+func grpcServerBlock(host string, paths []HTTPPath, port int) string {
+	var b strings.Builder
+	b.WriteString("server {\n")
+	b.WriteString(fmt.Sprintf("    listen %d http2;\n", port))
+	b.WriteString(fmt.Sprintf("    listen [::]:%d http2;\n", port))
+	b.WriteString(fmt.Sprintf("    server_name %s;\n\n", host))
+	seen := map[string]bool{}
+	for _, p := range paths {
+		pp, up := strings.TrimSpace(p.PathPrefix), strings.TrimSpace(p.Upstream)
+		if p.transport() != transportGRPC || pp == "" || pp[0] != '/' || up == "" || seen[pp] {
+			continue
+		}
+		seen[pp] = true
+		b.WriteString(grpcLocation(pp, up))
+	}
+	b.WriteString("    location / { return 404; }\n")
+	b.WriteString("}\n\n")
+	return b.String()
+}
+
+// grpcPort is the h2c port gRPC paths are served on.
+func (c Config) grpcPort() int {
+	if c.GRPCPort > 0 && c.GRPCPort <= 65535 {
+		return c.GRPCPort
+	}
+	return defaultGRPCPort
+}
+
+func hasGRPCPath(h HTTPHost) bool {
+	for _, p := range h.Paths {
+		if p.transport() == transportGRPC {
+			return true
+		}
+	}
+	return false
+}
@@ -1,13 +1,67 @@
 package main
 
+import "time"
+
+type UpstreamServer struct {
+	Address     string `json:"address"`
+	Weight      int    `json:"weight,omitempty"`
+	MaxFails    int    `json:"max_fails,omitempty"`
+	FailTimeout string `json:"fail_timeout,omitempty"` // nginx time, e.g. "10s"
+	Backup      bool   `json:"backup,omitempty"`
+}
+
 type Mapping struct {
 	SNI      string `json:"sni"`
 	Upstream string `json:"upstream"`
+
+	// Servers turns the mapping into a named upstream group; Upstream is
+	// ignored when it is set.
+	Servers []UpstreamServer `json:"servers,omitempty"`
+	Balance string           `json:"balance,omitempty"` // "" (round-robin) | "least_conn" | "hash"
+
+	// ProxyProtocol sends a PROXY v1 header with the real client address.
+	ProxyProtocol bool `json:"proxy_protocol,omitempty"`
+
+	// ALPN narrows the mapping to clients whose preferred protocol is this
+	// one ("h2", "http/1.1", ...) or that offer none ("none"); "" matches any.
+	ALPN string `json:"alpn,omitempty"`
+
+	// Source records where the mapping came from; nil means added by hand.
+	Source *RouteSource `json:"source,omitempty"`
+}
+
+// RouteSource ties a route to the imported inbound it was created from.
+type RouteSource struct {
+	Kind      string `json:"kind"` // inbound source name: "xui", "xray", "marzban", "sing-box"
+	InboundID int    `json:"inbound_id,omitempty"`
+	Port      int    `json:"port"`
+}
+
+// StreamListener is an extra TLS listener with its own SNI map. The
+// top-level DefaultUP/Mappings make up the built-in :443 listener.
+type StreamListener struct {
+	Port                 int       `json:"port"`
+	Bind                 string    `json:"bind,omitempty"` // one address instead of all IPv4/IPv6
+	IPv4                 bool      `json:"ipv4"`
+	IPv6                 bool      `json:"ipv6"`
+	ReusePort            bool      `json:"reuseport"`
+	DefaultUP            string    `json:"default_upstream"`
+	DefaultProxyProtocol bool      `json:"default_proxy_protocol,omitempty"`
+	Mappings             []Mapping `json:"mappings"`
+
+	NoSNIUpstream    string `json:"no_sni_upstream,omitempty"`
+	RejectUnknownSNI bool   `json:"reject_unknown_sni,omitempty"`
+	BlackholeUP      string `json:"blackhole_upstream,omitempty"`
 }
 
 type HTTPPath struct {
 	PathPrefix string `json:"path_prefix"`
 	Upstream   string `json:"upstream"`
+	Transport  string `json:"transport,omitempty"` // "", ws, grpc, httpupgrade, splithttp, xhttp
+	// legacy: set by configs written before Transport, read via transport()
+	WebSocket bool `json:"websocket,omitempty"`
+
+	Source *RouteSource `json:"source,omitempty"`
 }
 
 type HTTPHost struct {
@@ -18,32 +72,96 @@ type HTTPHost struct {
 
 type Config struct {
 	// STREAM
-	ListenPort443 bool      `json:"listen_port_443"`
-	DefaultUP     string    `json:"default_upstream"`
-	Mappings      []Mapping `json:"mappings"`
+	ListenPort443        bool      `json:"listen_port_443"`
+	DefaultUP            string    `json:"default_upstream"`
+	DefaultProxyProtocol bool      `json:"default_proxy_protocol,omitempty"`
+	Mappings             []Mapping `json:"mappings"`
+
+	// ClientHellos without SNI go to NoSNIUpstream ("reject" closes them,
+	// "" treats them like unknown names). With RejectUnknownSNI, names that
+	// match no mapping go to BlackholeUP, or are closed if it is empty.
+	NoSNIUpstream    string `json:"no_sni_upstream,omitempty"`
+	RejectUnknownSNI bool   `json:"reject_unknown_sni,omitempty"`
+	BlackholeUP      string `json:"blackhole_upstream,omitempty"`
+
+	// extra stream listeners, each with its own SNI map
+	StreamListeners []StreamListener `json:"stream_listeners,omitempty"`
 
 	// HTTP
 	HTTPEnabled   bool       `json:"http_enabled"`
 	DefaultHTTPUP string     `json:"default_http_upstream"`
 	HTTPHosts     []HTTPHost `json:"http_hosts"`
+	// plaintext HTTP/2 port gRPC paths are served on (0 = 50051); they
+	// cannot share :80 with HTTP/1.1
+	GRPCPort int `json:"grpc_port,omitempty"`
+
+	// IncludeMode writes only stream.conf/http.conf under /etc/nginx/snirouter
+	// and includes them from the host nginx.conf instead of replacing it.
+	IncludeMode bool `json:"include_mode"`
+
+	// XUISync: "" (off), "queue" (changes wait for approval) or "managed"
+	// (x-ui changes are applied as soon as they are seen)
+	XUISync string `json:"xui_sync,omitempty"`
 
 	// Admin
 	AdminPath string `json:"admin_path"`
+
+	// panel login lifetime (Go duration, "" = 24h) and inactivity limit
+	// ("" = none)
+	SessionTTL         string `json:"session_ttl,omitempty"`
+	SessionIdleTimeout string `json:"session_idle_timeout,omitempty"`
+}
+
+type ConfigRevision struct {
+	ID     int       `json:"id"`
+	Time   time.Time `json:"time"`
+	Author string    `json:"author"`
+	Reason string    `json:"reason"`
+	Config *Config   `json:"config,omitempty"`
+}
+
+type NginxPreview struct {
+	Rendered   string `json:"rendered"`
+	Diff       string `json:"diff"`
+	TestOK     bool   `json:"test_ok"`
+	TestOutput string `json:"test_output,omitempty"`
 }
 
 type adminCred struct {
 	User string
+	Hash string // bcrypt
+	// Pass is only set when read from a file written before hashing, until
+	// ensureAdminCreds migrates it
 	Pass string
 }
 
 type XUICandidate struct {
-	ID     int    `json:"id"`
-	Remark string `json:"remark,omitempty"`
-	Type   string `json:"type"` // "tls" | "http"
-	Port   int    `json:"port"`
-	SNI    string `json:"sni,omitempty"`
-	Host   string `json:"host,omitempty"`
-	Path   string `json:"path,omitempty"`
+	ID        string `json:"id"`                   // content hash, see candidateID
+	Source    string `json:"source,omitempty"`     // inbound source name, e.g. "xui"
+	InboundID int    `json:"inbound_id,omitempty"` // x-ui inbounds.id; 0 from the text scanner
+	Remark    string `json:"remark,omitempty"`
+	Type      string `json:"type"` // "tls" | "http"
+	Port      int    `json:"port"`
+	SNI       string `json:"sni,omitempty"`
+	Host      string `json:"host,omitempty"`
+	Path      string `json:"path,omitempty"`
+
+	// inbound listen address as set in x-ui ("" = all interfaces); may be a
+	// unix socket path
+	Listen string `json:"listen,omitempty"`
+	// inbound is switched off in x-ui
+	Disabled bool `json:"disabled,omitempty"`
+
+	// inbound has acceptProxyProtocol set
+	ProxyProtocol bool `json:"proxy_protocol,omitempty"`
+	// http candidate transport (see HTTPPath.Transport)
+	Transport string `json:"transport,omitempty"`
+
+	// against the current config, see annotateCandidate
+	Status         string       `json:"status,omitempty"` // new | identical | changed | conflict
+	Existing       string       `json:"existing,omitempty"`
+	ExistingSource *RouteSource `json:"existing_source,omitempty"`
+	Overlap        string       `json:"overlap,omitempty"`
 }
 
 type span struct{ s, e int }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strings"
+)
+
+const (
+	balanceRoundRobin = ""
+	balanceLeastConn  = "least_conn"
+	balanceHash       = "hash"
+)
+
+var (
+	reNginxTime    = regexp.MustCompile(`^[0-9]+(ms|s|m|h)?$`)
+	reUpstreamName = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+func (m Mapping) isGroup() bool { return len(m.Servers) > 0 }
+
+// normalizeServers trims and validates an upstream group in place.
+func normalizeServers(servers []UpstreamServer, balance string) error {
+	switch balance {
+	case balanceRoundRobin, balanceLeastConn, balanceHash:
+	default:
+		return fmt.Errorf("unknown balance %q (want least_conn, hash or empty for round-robin)", balance)
+	}
+	primaries := 0
+	for i := range servers {
+		s := &servers[i]
+		s.Address = strings.TrimSpace(s.Address)
+		s.FailTimeout = strings.TrimSpace(s.FailTimeout)
+		if s.Address == "" || strings.ContainsAny(s.Address, " ;{}\"") {
+			return fmt.Errorf("server %d: invalid address %q", i+1, s.Address)
+		}
+		if s.Weight < 0 || s.MaxFails < 0 {
+			return fmt.Errorf("server %d: weight/max_fails must not be negative", i+1)
+		}
+		if s.FailTimeout != "" && !reNginxTime.MatchString(s.FailTimeout) {
+			return fmt.Errorf("server %d: invalid fail_timeout %q", i+1, s.FailTimeout)
+		}
+		if s.Backup && balance == balanceHash {
+			return errors.New("backup servers cannot be used with hash balancing")
+		}
+		if !s.Backup {
+			primaries++
+		}
+	}
+	if primaries == 0 {
+		return errors.New("upstream group needs at least one non-backup server")
+	}
+	return nil
+}
+
+// upstreamName derives a stable nginx upstream name from the SNI key.
+func upstreamName(sni string) string {
+	h := fnv.New32a()
+	h.Write([]byte(strings.ToLower(sni)))
+	base := strings.Trim(reUpstreamName.ReplaceAllString(strings.ToLower(sni), "_"), "_")
+	if len(base) > 40 {
+		base = base[:40]
+	}
+	return fmt.Sprintf("sni_%s_%08x", base, h.Sum32())
+}
+
+func generateUpstreamGroup(name string, m Mapping) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "    upstream %s {\n", name)
+	switch m.Balance {
+	case balanceLeastConn:
+		b.WriteString("        least_conn;\n")
+	case balanceHash:
+		b.WriteString("        hash $remote_addr;\n")
+	}
+	for _, s := range m.Servers {
+		b.WriteString("        server " + s.Address)
+		if s.Weight > 0 {
+			fmt.Fprintf(&b, " weight=%d", s.Weight)
+		}
+		if s.MaxFails > 0 {
+			fmt.Fprintf(&b, " max_fails=%d", s.MaxFails)
+		}
+		if s.FailTimeout != "" {
+			b.WriteString(" fail_timeout=" + s.FailTimeout)
+		}
+		if s.Backup {
+			b.WriteString(" backup")
+		}
+		b.WriteString(";\n")
+	}
+	b.WriteString("    }\n")
+	return b.String()
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Panel roles, each including the ones before it: viewers read config and
+// status, operators change routes and reload nginx, admins also manage
+// users, nginx installation and panel settings.
+const (
+	roleViewer   = "viewer"
+	roleOperator = "operator"
+	roleAdmin    = "admin"
+)
+
+var roleRank = map[string]int{roleViewer: 1, roleOperator: 2, roleAdmin: 3}
+
+const minPasswordLen = 8
+
+var (
+	errWrongPassword = errors.New("current password is wrong")
+	errLastAdmin     = errors.New("at least one admin must remain")
+	errWrongCode     = errors.New("wrong code")
+
+	reUserName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+)
+
+type panelUser struct {
+	Name    string    `json:"name"`
+	Hash    string    `json:"hash"` // bcrypt
+	Role    string    `json:"role"`
+	Created time.Time `json:"created"`
+
+	// TOTP second factor: the active secret, one awaiting its first code
+	// during setup, the last step used (codes are single-use) and the
+	// SHA-256 hashes of the unused recovery codes
+	TOTPSecret    string   `json:"totp_secret,omitempty"`
+	TOTPPending   string   `json:"totp_pending,omitempty"`
+	TOTPLastStep  int64    `json:"totp_last_step,omitempty"`
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+}
+
+// users is the in-memory copy of usersPath; usersMu guards both.
+var (
+	usersMu sync.Mutex
+	users   []panelUser
+)
+
+func hasRole(role, need string) bool { return roleRank[role] >= roleRank[need] }
+
+func validateRole(role string) error {
+	if roleRank[role] == 0 {
+		return fmt.Errorf("unknown role %q", role)
+	}
+	return nil
+}
+
+func validatePassword(p string) error {
+	if len(p) < minPasswordLen || len(p) > 72 { // bcrypt ignores anything past 72 bytes
+		return fmt.Errorf("password must be %d to 72 characters", minPasswordLen)
+	}
+	return nil
+}
+
+func loadUsers() ([]panelUser, error) {
+	b, err := os.ReadFile(usersPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Users []panelUser `json:"users"`
+	}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %v", usersPath, err)
+	}
+	return doc.Users, nil
+}
+
+// saveUsers writes us and makes it current. Caller holds usersMu.
+func saveUsers(us []panelUser) error {
+	sort.Slice(us, func(i, j int) bool { return us[i].Name < us[j].Name })
+	doc := struct {
+		Users []panelUser `json:"users"`
+	}{us}
+	if err := writeAtomic(usersPath, mustJSON(doc), 0600); err != nil {
+		return err
+	}
+	users = us
+	return nil
+}
+
+// ensureUsers loads the user store. The first start creates it from the
+// ADMIN.txt account, which from then on only records the panel path and the
+// name of that first admin.
+func ensureUsers() error {
+	usersMu.Lock()
+	defer usersMu.Unlock()
+	us, err := loadUsers()
+	if err != nil {
+		return err
+	}
+	if len(us) > 0 {
+		users = us
+		return nil
+	}
+	cr, err := ensureAdminCreds()
+	if err != nil {
+		return err
+	}
+	if err := saveUsers([]panelUser{{Name: cr.User, Hash: cr.Hash, Role: roleAdmin, Created: time.Now().UTC()}}); err != nil {
+		return err
+	}
+	cr.Hash = ""
+	if err := writeAdminCreds(cr); err != nil {
+		return err
+	}
+	log.Printf("[auth] created %s with %s as admin", usersPath, cr.User)
+	return nil
+}
+
+func findUser(name string) (panelUser, bool) {
+	usersMu.Lock()
+	defer usersMu.Unlock()
+	for _, u := range users {
+		if u.Name == name {
+			return u, true
+		}
+	}
+	return panelUser{}, false
+}
+
+// dummyHash is compared against when the user does not exist, so a login
+// takes as long for unknown names as for wrong passwords.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("snirouter"), bcrypt.DefaultCost)
+
+// authenticate checks a login in constant time.
+func authenticate(name, pass string) (panelUser, bool) {
+	usersMu.Lock()
+	var found panelUser
+	ok := false
+	for _, u := range users {
+		if subtle.ConstantTimeCompare([]byte(u.Name), []byte(name)) == 1 {
+			found, ok = u, true
+		}
+	}
+	usersMu.Unlock()
+
+	hash := dummyHash
+	if ok {
+		hash = []byte(found.Hash)
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(pass)) != nil || !ok {
+		return panelUser{}, false
+	}
+	return found, true
+}
+
+// changePassword sets name's password after checking the current one.
+func changePassword(name, current, next string) error {
+	if _, ok := authenticate(name, current); !ok {
+		return errWrongPassword
+	}
+	return setUser(name, "", next)
+}
+
+// setUser creates name or updates its role and/or password; empty values
+// are left unchanged on update but both are required to create.
+func setUser(name, role, pass string) error {
+	if !reUserName.MatchString(name) {
+		return fmt.Errorf("invalid user name %q", name)
+	}
+	if role != "" {
+		if err := validateRole(role); err != nil {
+			return err
+		}
+	}
+	var hash string
+	if pass != "" {
+		if err := validatePassword(pass); err != nil {
+			return err
+		}
+		h, err := hashPassword(pass)
+		if err != nil {
+			return err
+		}
+		hash = h
+	}
+
+	usersMu.Lock()
+	defer usersMu.Unlock()
+	us := append([]panelUser(nil), users...)
+	i := indexUser(us, name)
+	if i < 0 {
+		if role == "" || hash == "" {
+			return errors.New("a new user needs a role and a password")
+		}
+		us = append(us, panelUser{Name: name, Role: role, Hash: hash, Created: time.Now().UTC()})
+		return saveUsers(us)
+	}
+	if role != "" {
+		us[i].Role = role
+	}
+	if hash != "" {
+		us[i].Hash = hash
+	}
+	if !hasAdmin(us) {
+		return errLastAdmin
+	}
+	return saveUsers(us)
+}
+
+func deleteUser(name string) error {
+	usersMu.Lock()
+	defer usersMu.Unlock()
+	i := indexUser(users, name)
+	if i < 0 {
+		return fmt.Errorf("no user %q", name)
+	}
+	us := append(append([]panelUser(nil), users[:i]...), users[i+1:]...)
+	if !hasAdmin(us) {
+		return errLastAdmin
+	}
+	return saveUsers(us)
+}
+
+func indexUser(us []panelUser, name string) int {
+	for i, u := range us {
+		if u.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func hasAdmin(us []panelUser) bool {
+	for _, u := range us {
+		if u.Role == roleAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// updateUser applies fn to name's record and saves it if fn succeeds.
+func updateUser(name string, fn func(*panelUser) error) error {
+	usersMu.Lock()
+	defer usersMu.Unlock()
+	us := append([]panelUser(nil), users...)
+	i := indexUser(us, name)
+	if i < 0 {
+		return fmt.Errorf("no user %q", name)
+	}
+	if err := fn(&us[i]); err != nil {
+		return err
+	}
+	return saveUsers(us)
+}
+
+// beginTOTP starts enrolment with a fresh secret; it only takes effect once
+// confirmed by enableTOTP.
+func beginTOTP(name string) (string, error) {
+	secret := newTOTPSecret()
+	return secret, updateUser(name, func(u *panelUser) error {
+		u.TOTPPending = secret
+		return nil
+	})
+}
+
+// enableTOTP activates the pending secret if code matches it and returns
+// new recovery codes.
+func enableTOTP(name, code string) ([]string, error) {
+	var codes []string
+	err := updateUser(name, func(u *panelUser) error {
+		if u.TOTPPending == "" {
+			return errors.New("start two-factor setup first")
+		}
+		step, ok := verifyTOTP(u.TOTPPending, code, time.Now(), 0)
+		if !ok {
+			return errors.New("code does not match, check the device clock")
+		}
+		var hashes []string
+		codes, hashes = newRecoveryCodes()
+		u.TOTPSecret, u.TOTPPending, u.TOTPLastStep, u.RecoveryCodes = u.TOTPPending, "", step, hashes
+		return nil
+	})
+	return codes, err
+}
+
+func disableTOTP(name string) error {
+	return updateUser(name, func(u *panelUser) error {
+		u.TOTPSecret, u.TOTPPending, u.TOTPLastStep, u.RecoveryCodes = "", "", 0, nil
+		return nil
+	})
+}
+
+// checkSecondFactor accepts a current TOTP code or an unused recovery code,
+// using it up.
+func checkSecondFactor(name, code string) bool {
+	err := updateUser(name, func(u *panelUser) error {
+		if u.TOTPSecret == "" {
+			return errors.New("two-factor not enabled")
+		}
+		if step, ok := verifyTOTP(u.TOTPSecret, code, time.Now(), u.TOTPLastStep); ok {
+			u.TOTPLastStep = step
+			return nil
+		}
+		h := hashRecoveryCode(code)
+		for i, rc := range u.RecoveryCodes {
+			if subtle.ConstantTimeCompare([]byte(rc), []byte(h)) == 1 {
+				u.RecoveryCodes = append(u.RecoveryCodes[:i:i], u.RecoveryCodes[i+1:]...)
+				log.Printf("[auth] %s used a recovery code, %d left", name, len(u.RecoveryCodes))
+				return nil
+			}
+		}
+		return errWrongCode
+	})
+	return err == nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// xuiInbound is one row of x-ui's inbounds table.
+type xuiInbound struct {
+	ID             int
+	Remark         string
+	Port           int
+	Listen         string
+	Enable         bool
+	Protocol       string
+	StreamSettings string
+	Sniffing       string
+}
+
+type xuiPPFlag struct {
+	AcceptProxyProtocol bool `json:"acceptProxyProtocol"`
+}
+
+type xuiHostPath struct {
+	xuiPPFlag
+	Path string `json:"path"`
+	Host string `json:"host"`
+}
+
+// xuiStream mirrors the parts of Xray's streamSettings the router cares about.
+type xuiStream struct {
+	Network  string `json:"network"`
+	Security string `json:"security"`
+
+	TLSSettings struct {
+		ServerName string `json:"serverName"`
+	} `json:"tlsSettings"`
+	RealitySettings struct {
+		ServerNames []string `json:"serverNames"`
+	} `json:"realitySettings"`
+
+	TCPSettings struct {
+		xuiPPFlag
+		Header struct {
+			Type    string `json:"type"`
+			Request struct {
+				Path    []string                   `json:"path"`
+				Headers map[string]json.RawMessage `json:"headers"`
+			} `json:"request"`
+		} `json:"header"`
+	} `json:"tcpSettings"`
+	WSSettings struct {
+		xuiHostPath
+		Headers map[string]string `json:"headers"`
+	} `json:"wsSettings"`
+	HTTPSettings struct {
+		Path string   `json:"path"`
+		Host []string `json:"host"`
+	} `json:"httpSettings"`
+	GRPCSettings struct {
+		ServiceName string `json:"serviceName"`
+		Authority   string `json:"authority"`
+	} `json:"grpcSettings"`
+	HTTPUpgradeSettings xuiHostPath `json:"httpupgradeSettings"`
+	SplitHTTPSettings   xuiHostPath `json:"splithttpSettings"`
+	XHTTPSettings       xuiHostPath `json:"xhttpSettings"`
+
+	Sockopt xuiPPFlag `json:"sockopt"`
+}
+
+func readXUIInbounds(path string) ([]xuiInbound, error) {
+	db, err := openSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.readTable("inbounds")
+	if err != nil {
+		return nil, err
+	}
+	out := make([]xuiInbound, 0, len(rows))
+	for _, r := range rows {
+		out = append(out, xuiInbound{
+			ID:             int(sqlInt(r["id"])),
+			Remark:         sqlText(r["remark"]),
+			Port:           int(sqlInt(r["port"])),
+			Listen:         sqlText(r["listen"]),
+			Enable:         sqlInt(r["enable"]) != 0,
+			Protocol:       sqlText(r["protocol"]),
+			StreamSettings: sqlText(r["stream_settings"]),
+			Sniffing:       sqlText(r["sniffing"]),
+		})
+	}
+	return out, nil
+}
+
+func sqlInt(v interface{}) int64 {
+	switch x := v.(type) {
+	case int64:
+		return x
+	case float64:
+		return int64(x)
+	case string:
+		var n int64
+		fmt.Sscan(x, &n)
+		return n
+	}
+	return 0
+}
+
+func sqlText(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case []byte:
+		return string(x)
+	}
+	return ""
+}
+
+// hostPath returns the HTTP host, path and transport (as in
+// findHTTPHostPath) the stream is reachable on, if any.
+func (s xuiStream) hostPath() (string, string, string) {
+	switch s.Network {
+	case "tcp", "":
+		if s.TCPSettings.Header.Type != "http" {
+			return "", "", ""
+		}
+		req := s.TCPSettings.Header.Request
+		host := ""
+		for k, v := range req.Headers {
+			if strings.EqualFold(k, "host") {
+				host = pickFirstString(string(v))
+			}
+		}
+		p := "/"
+		if len(req.Path) > 0 {
+			p = nonEmptyPath(req.Path[0])
+		}
+		return host, p, "tcp"
+	case "ws":
+		host := s.WSSettings.Host
+		for k, v := range s.WSSettings.Headers {
+			if host == "" && strings.EqualFold(k, "host") {
+				host = v
+			}
+		}
+		return host, nonEmptyPath(s.WSSettings.Path), "ws"
+	case "http", "h2":
+		host := ""
+		if len(s.HTTPSettings.Host) > 0 {
+			host = s.HTTPSettings.Host[0]
+		}
+		return host, nonEmptyPath(s.HTTPSettings.Path), "h2"
+	case transportGRPC:
+		if strings.TrimSpace(s.GRPCSettings.ServiceName) == "" {
+			return "", "", ""
+		}
+		return s.GRPCSettings.Authority, grpcServicePath(s.GRPCSettings.ServiceName), transportGRPC
+	case transportHTTPUpgrade:
+		return s.HTTPUpgradeSettings.Host, nonEmptyPath(s.HTTPUpgradeSettings.Path), transportHTTPUpgrade
+	case transportSplitHTTP:
+		return s.SplitHTTPSettings.Host, nonEmptyPath(s.SplitHTTPSettings.Path), transportSplitHTTP
+	case transportXHTTP:
+		return s.XHTTPSettings.Host, nonEmptyPath(s.XHTTPSettings.Path), transportXHTTP
+	}
+	return "", "", ""
+}
+
+// snis lists the names clients reach the inbound with: the TLS serverName
+// or every REALITY serverName.
+func (s xuiStream) snis() []string {
+	var names []string
+	switch s.Security {
+	case "tls":
+		names = []string{s.TLSSettings.ServerName}
+	case "reality":
+		names = s.RealitySettings.ServerNames
+	}
+	var out []string
+	for _, n := range names {
+		if n = strings.TrimSpace(n); n != "" {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+func (s xuiStream) acceptsProxyProtocol() bool {
+	return s.Sockopt.AcceptProxyProtocol || s.TCPSettings.AcceptProxyProtocol ||
+		s.WSSettings.AcceptProxyProtocol || s.HTTPUpgradeSettings.AcceptProxyProtocol
+}
+
+// streamCandidates fills the routing fields of base from an inbound's stream
+// settings: one candidate per SNI, else one for its HTTP host/path, else none.
+func streamCandidates(base XUICandidate, st xuiStream) []XUICandidate {
+	if snis := st.snis(); len(snis) > 0 {
+		out := make([]XUICandidate, 0, len(snis))
+		for _, sni := range snis {
+			c := base
+			c.Type, c.SNI, c.ProxyProtocol = "tls", sni, st.acceptsProxyProtocol()
+			out = append(out, c)
+		}
+		return out
+	}
+	host, path, transport := st.hostPath()
+	host = strings.TrimSpace(host)
+	if host == "" && !hostlessTransport(transport) {
+		return nil
+	}
+	c := base
+	c.Type, c.Host, c.Path, c.Transport = "http", host, path, candidateTransport(transport)
+	return []XUICandidate{c}
+}
+
+// candidatesFromInbounds builds scan results from inbounds rows, deduplicated
+// the same way as the text scanner.
+func candidatesFromInbounds(ins []xuiInbound) []XUICandidate {
+	var out []XUICandidate
+	for _, in := range ins {
+		if strings.TrimSpace(in.StreamSettings) == "" {
+			continue
+		}
+		var st xuiStream
+		if err := json.Unmarshal([]byte(in.StreamSettings), &st); err != nil {
+			log.Printf("[inbounds] inbound %d (%s): bad stream settings: %v", in.ID, in.Remark, err)
+			continue
+		}
+		base := XUICandidate{InboundID: in.ID, Remark: in.Remark, Port: in.Port, Listen: strings.TrimSpace(in.Listen), Disabled: !in.Enable}
+		out = append(out, streamCandidates(base, st)...)
+	}
+	return dedupCandidates(out)
+}
@@ -0,0 +1,115 @@
+package main
+
+import "strings"
+
+const sourceXUI = "xui"
+
+// candidateSourceName is the source a candidate came from; sync state saved
+// before sources existed only holds x-ui candidates.
+func candidateSourceName(it XUICandidate) string {
+	if it.Source == "" {
+		return sourceXUI
+	}
+	return it.Source
+}
+
+func candidateSource(it XUICandidate) *RouteSource {
+	return &RouteSource{Kind: candidateSourceName(it), InboundID: it.InboundID, Port: it.Port}
+}
+
+// is reports whether s was created from the same inbound as it. Inbound ids
+// are compared when both sides have one (SQLite scans); other sources only
+// know the port.
+func (s *RouteSource) is(it XUICandidate) bool {
+	if s == nil || s.Kind != candidateSourceName(it) {
+		return false
+	}
+	if s.InboundID != 0 && it.InboundID != 0 {
+		return s.InboundID == it.InboundID
+	}
+	return s.Port == it.Port
+}
+
+// orphanRoute is an imported route whose inbound no longer offers it
+// (deleted or serving another SNI/host now). The same shape lists routes
+// whose inbound is only disabled; those are kept.
+type orphanRoute struct {
+	Listener int         `json:"listener,omitempty"` // extra stream listener port
+	SNI      string      `json:"sni,omitempty"`
+	ALPN     string      `json:"alpn,omitempty"`
+	Host     string      `json:"host,omitempty"`
+	Path     string      `json:"path,omitempty"`
+	Upstream string      `json:"upstream"`
+	Source   RouteSource `json:"source"`
+}
+
+// xuiRouteLive reports whether a current scan result still backs the route
+// with the given xuiRouteKey, and whether any of those results is enabled.
+func xuiRouteLive(src *RouteSource, key string, items []XUICandidate) (live, enabled bool) {
+	for _, it := range items {
+		if src.is(it) && xuiRouteKey(it) == key {
+			live = true
+			enabled = enabled || !it.Disabled
+		}
+	}
+	return live, enabled
+}
+
+// pruneOrphans removes mappings and HTTP paths imported from source that
+// items (a fresh scan of it, disabled inbounds included) no longer back and
+// returns what it removed, plus the kept routes whose inbound is disabled.
+// Manual routes and other sources' routes are never touched.
+func pruneOrphans(cfg *Config, source string, items []XUICandidate) (removed, disabled []orphanRoute) {
+	pruneMappings := func(ms []Mapping, listener int) []Mapping {
+		kept := ms[:0]
+		for _, m := range ms {
+			if m.Source != nil && m.Source.Kind == source {
+				o := orphanRoute{Listener: listener, SNI: m.SNI, ALPN: m.ALPN, Upstream: m.Upstream, Source: *m.Source}
+				live, enabled := xuiRouteLive(m.Source, xuiRouteKey(XUICandidate{Type: "tls", SNI: m.SNI}), items)
+				if !live {
+					removed = append(removed, o)
+					continue
+				}
+				if !enabled {
+					disabled = append(disabled, o)
+				}
+			}
+			kept = append(kept, m)
+		}
+		return kept
+	}
+	cfg.Mappings = pruneMappings(cfg.Mappings, 0)
+	for i := range cfg.StreamListeners {
+		l := &cfg.StreamListeners[i]
+		l.Mappings = pruneMappings(l.Mappings, l.Port)
+	}
+
+	hosts := cfg.HTTPHosts[:0]
+	for _, h := range cfg.HTTPHosts {
+		paths := h.Paths[:0]
+		pruned := false
+		for _, p := range h.Paths {
+			if p.Source != nil && p.Source.Kind == source {
+				o := orphanRoute{Host: h.Host, Path: p.PathPrefix, Upstream: p.Upstream, Source: *p.Source}
+				live, enabled := xuiRouteLive(p.Source, xuiRouteKey(XUICandidate{Type: "http", Host: h.Host, Path: p.PathPrefix}), items)
+				if !live {
+					removed = append(removed, o)
+					pruned = true
+					continue
+				}
+				if !enabled {
+					disabled = append(disabled, o)
+				}
+			}
+			paths = append(paths, p)
+		}
+		h.Paths = paths
+		// a host that only existed for pruned paths goes with them
+		if pruned && len(h.Paths) == 0 && strings.TrimSpace(h.Fallback) == "" {
+			continue
+		}
+		hosts = append(hosts, h)
+	}
+	cfg.HTTPHosts = hosts
+	return removed, disabled
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"log"
 	"os"
 	"regexp"
@@ -12,15 +14,16 @@ import (
 
 // ---------- REGEX PATTERNS ----------
 var (
-	reHasAnyStream = regexp.MustCompile(`"tlsSettings"|"realitySettings"|"tcpSettings"|"wsSettings"|"httpSettings"|"security"`)
+	reHasAnyStream = regexp.MustCompile(`"tlsSettings"|"realitySettings"|"tcpSettings"|"wsSettings"|"httpSettings"|"grpcSettings"|"httpupgradeSettings"|"splithttpSettings"|"xhttpSettings"|"security"`)
 	reInboundNear  = regexp.MustCompile(`inbound-([0-9]{1,5})\s*\{`)
 	rePortField    = regexp.MustCompile(`"port"\s*:\s*([0-9]{1,5})`)
 
 	// TLS: tlsSettings.serverName
 	reTLSserverName = regexp.MustCompile(`(?s)"tlsSettings"\s*:\s*\{.*?"serverName"\s*:\s*"([^"]+)"`)
 
-	// REALITY: realitySettings.serverNames[0]
-	reRealitySN = regexp.MustCompile(`(?s)"realitySettings"\s*:\s*\{.*?"serverNames"\s*:\s*\[\s*"([^"]+)"`)
+	// REALITY: every realitySettings.serverNames entry
+	reRealitySN = regexp.MustCompile(`(?s)"realitySettings"\s*:\s*\{.*?"serverNames"\s*:\s*\[([^\]]*)\]`)
+	reJSONStr   = regexp.MustCompile(`"([^"]+)"`)
 
 	// TCP (http header emulation): request.headers.Host / host and request.path
 	reTCPHost = regexp.MustCompile(`(?s)"tcpSettings"\s*:\s*\{.*?"request"\s*:\s*\{.*?"headers"\s*:\s*\{.*?(?:"Host"|"host")\s*:\s*(\[[^\]]+\]|"[^"]+")`)
@@ -32,12 +35,20 @@ var (
 	// HTTP/2 h2c: httpSettings.host / path
 	reHTTPHost = regexp.MustCompile(`(?s)"httpSettings"\s*:\s*\{.*?"host"\s*:\s*(\[[^\]]+\]|"[^"]+")`)
 	reHTTPPath = regexp.MustCompile(`(?s)"httpSettings"\s*:\s*\{.*?"path"\s*:\s*"([^"]*)"`)
-)
 
-func xuiPresent() bool {
-	st, err := os.Stat(xuiDBPath)
-	return err == nil && !st.IsDir()
-}
+	// gRPC: grpcSettings.serviceName and optional authority (used as Host)
+	reGRPCService   = regexp.MustCompile(`(?s)"grpcSettings"\s*:\s*\{.*?"serviceName"\s*:\s*"([^"]*)"`)
+	reGRPCAuthority = regexp.MustCompile(`(?s)"grpcSettings"\s*:\s*\{.*?"authority"\s*:\s*"([^"]+)"`)
+	// HTTPUpgrade: httpupgradeSettings.host / path
+	reHUHost = regexp.MustCompile(`(?s)"httpupgradeSettings"\s*:\s*\{.*?"host"\s*:\s*"([^"]+)"`)
+	reHUPath = regexp.MustCompile(`(?s)"httpupgradeSettings"\s*:\s*\{.*?"path"\s*:\s*"([^"]*)"`)
+	// SplitHTTP / XHTTP: (splithttp|xhttp)Settings.host / path
+	reSplitHost = regexp.MustCompile(`(?s)"(splithttp|xhttp)Settings"\s*:\s*\{.*?"host"\s*:\s*"([^"]+)"`)
+	reSplitPath = regexp.MustCompile(`(?s)"(splithttp|xhttp)Settings"\s*:\s*\{.*?"path"\s*:\s*"([^"]*)"`)
+
+	// any transport: acceptProxyProtocol (inbound expects a PROXY header)
+	reAcceptPP = regexp.MustCompile(`"acceptProxyProtocol"\s*:\s*true`)
+)
 
 func extractAllJSONObjects(data []byte, maxSize int) []span {
 	var out []span
@@ -103,17 +114,46 @@ func pickFirstString(jsonish string) string {
 	return ""
 }
 
-func findSNI(chunk string) string {
+func findSNIs(chunk string) []string {
 	if m := reTLSserverName.FindStringSubmatch(chunk); len(m) == 2 {
-		return strings.TrimSpace(m[1])
+		return []string{strings.TrimSpace(m[1])}
 	}
 	if m := reRealitySN.FindStringSubmatch(chunk); len(m) == 2 {
-		return strings.TrimSpace(m[1])
+		var out []string
+		for _, n := range reJSONStr.FindAllStringSubmatch(m[1], -1) {
+			if n := strings.TrimSpace(n[1]); n != "" {
+				out = append(out, n)
+			}
+		}
+		return out
 	}
-	return ""
+	return nil
 }
 
-func findHTTPHostPath(chunk string) (string, string) {
+// chunkCandidates turns one stream settings object found by the text scan
+// into candidates: one per SNI, else one for its HTTP host/path.
+func chunkCandidates(chunk string, port int) []XUICandidate {
+	if snis := findSNIs(chunk); len(snis) > 0 {
+		pp := reAcceptPP.MatchString(chunk)
+		out := make([]XUICandidate, 0, len(snis))
+		for _, sni := range snis {
+			out = append(out, XUICandidate{Type: "tls", Port: port, SNI: sni, ProxyProtocol: pp})
+		}
+		return out
+	}
+	host, path, transport := findHTTPHostPath(chunk)
+	if host == "" && !hostlessTransport(transport) {
+		return nil
+	}
+	if path == "" {
+		path = "/"
+	}
+	return []XUICandidate{{Type: "http", Port: port, Host: host, Path: path, Transport: candidateTransport(transport)}}
+}
+
+// findHTTPHostPath returns host, path and the transport ("tcp", "ws", "h2")
+// they were found in.
+func findHTTPHostPath(chunk string) (string, string, string) {
 	if m := reTCPHost.FindStringSubmatch(chunk); len(m) == 2 {
 		h := pickFirstString(m[1])
 		p := "/"
@@ -123,7 +163,7 @@ func findHTTPHostPath(chunk string) (string, string) {
 				p = "/"
 			}
 		}
-		return strings.TrimSpace(h), p
+		return strings.TrimSpace(h), p, "tcp"
 	}
 	if m := reWSHost.FindStringSubmatch(chunk); len(m) == 2 {
 		h := pickFirstString(m[1])
@@ -131,7 +171,7 @@ func findHTTPHostPath(chunk string) (string, string) {
 		if mp := reWSPath.FindStringSubmatch(chunk); len(mp) == 2 && strings.TrimSpace(mp[1]) != "" {
 			p = mp[1]
 		}
-		return strings.TrimSpace(h), p
+		return strings.TrimSpace(h), p, "ws"
 	}
 	if m := reHTTPHost.FindStringSubmatch(chunk); len(m) == 2 {
 		h := pickFirstString(m[1])
@@ -139,9 +179,57 @@ func findHTTPHostPath(chunk string) (string, string) {
 		if mp := reHTTPPath.FindStringSubmatch(chunk); len(mp) == 2 && strings.TrimSpace(mp[1]) != "" {
 			p = mp[1]
 		}
-		return strings.TrimSpace(h), p
+		return strings.TrimSpace(h), p, "h2"
+	}
+	// the transports below are reported even without a host, so the panel
+	// shows them instead of dropping the inbound
+	if m := reGRPCService.FindStringSubmatch(chunk); len(m) == 2 && strings.TrimSpace(m[1]) != "" {
+		h := ""
+		if ma := reGRPCAuthority.FindStringSubmatch(chunk); len(ma) == 2 {
+			h = ma[1]
+		}
+		return strings.TrimSpace(h), grpcServicePath(m[1]), transportGRPC
+	}
+	if mp := reHUPath.FindStringSubmatch(chunk); len(mp) == 2 {
+		h := ""
+		if m := reHUHost.FindStringSubmatch(chunk); len(m) == 2 {
+			h = m[1]
+		}
+		return strings.TrimSpace(h), nonEmptyPath(mp[1]), transportHTTPUpgrade
 	}
-	return "", ""
+	if mp := reSplitPath.FindStringSubmatch(chunk); len(mp) == 3 {
+		h := ""
+		if m := reSplitHost.FindStringSubmatch(chunk); len(m) == 3 {
+			h = m[2]
+		}
+		return strings.TrimSpace(h), nonEmptyPath(mp[2]), mp[1]
+	}
+	return "", "", ""
+}
+
+// candidateTransport maps findHTTPHostPath's transport to HTTPPath.Transport;
+// tcp and h2 are both proxied as plain HTTP.
+func candidateTransport(t string) string {
+	switch t {
+	case "tcp", "h2":
+		return transportHTTP
+	}
+	return t
+}
+
+func hostlessTransport(t string) bool {
+	switch t {
+	case transportGRPC, transportHTTPUpgrade, transportSplitHTTP, transportXHTTP:
+		return true
+	}
+	return false
+}
+
+func nonEmptyPath(p string) string {
+	if strings.TrimSpace(p) == "" {
+		return "/"
+	}
+	return p
 }
 
 // ---- (A) Forward: object → inbound-PORT within 4KB ----
@@ -164,7 +252,6 @@ func scanForward(data []byte) []XUICandidate {
 	spans := extractAllJSONObjects(data, 8_000_000)
 	seen := map[string]bool{}
 	var out []XUICandidate
-	nextID := 1
 
 	for _, sp := range spans {
 		raw := data[sp.s:sp.e]
@@ -186,31 +273,11 @@ func scanForward(data []byte) []XUICandidate {
 			continue
 		}
 
-		sni := findSNI(chunk)
-		host, path := "", ""
-		if sni == "" {
-			host, path = findHTTPHostPath(chunk)
-		}
-		if sni == "" && host == "" {
-			continue
-		}
-
-		var cand XUICandidate
-		var key string
-		if sni != "" {
-			cand = XUICandidate{ID: nextID, Type: "tls", Port: port, SNI: sni}
-			key = fmt.Sprintf("tls|%s|%d", strings.ToLower(sni), port)
-		} else {
-			if path == "" {
-				path = "/"
+		for _, cand := range chunkCandidates(chunk, port) {
+			if key := candidateKey(cand); !seen[key] {
+				seen[key] = true
+				out = append(out, cand)
 			}
-			cand = XUICandidate{ID: nextID, Type: "http", Port: port, Host: host, Path: path}
-			key = fmt.Sprintf("http|%s|%s|%d", strings.ToLower(host), path, port)
-		}
-		if !seen[key] {
-			seen[key] = true
-			out = append(out, cand)
-			nextID++
 		}
 	}
 	log.Printf("[xui/text-strict/forward] candidates: %d", len(out))
@@ -232,7 +299,6 @@ func nearestObjectBefore(data []byte, idx int) (span, bool) {
 func scanBackward(data []byte) []XUICandidate {
 	var out []XUICandidate
 	seen := map[string]bool{}
-	nextID := 1
 
 	locs := reInboundNear.FindAllSubmatchIndex(data, -1)
 	for _, m := range locs {
@@ -254,30 +320,11 @@ func scanBackward(data []byte) []XUICandidate {
 		}
 		chunk := string(raw)
 
-		sni := findSNI(chunk)
-		host, path := "", ""
-		if sni == "" {
-			host, path = findHTTPHostPath(chunk)
-		}
-		if sni == "" && host == "" {
-			continue
-	}
-		var cand XUICandidate
-		var key string
-		if sni != "" {
-			cand = XUICandidate{ID: nextID, Type: "tls", Port: port, SNI: sni}
-			key = fmt.Sprintf("tls|%s|%d", strings.ToLower(sni), port)
-		} else {
-			if path == "" {
-				path = "/"
+		for _, cand := range chunkCandidates(chunk, port) {
+			if key := candidateKey(cand); !seen[key] {
+				seen[key] = true
+				out = append(out, cand)
 			}
-			cand = XUICandidate{ID: nextID, Type: "http", Port: port, Host: host, Path: path}
-			key = fmt.Sprintf("http|%s|%s|%d", strings.ToLower(host), path, port)
-		}
-		if !seen[key] {
-			seen[key] = true
-			out = append(out, cand)
-			nextID++
 		}
 	}
 
@@ -285,42 +332,90 @@ func scanBackward(data []byte) []XUICandidate {
 	return out
 }
 
-// ---- Dispatcher: forward ∪ backward ----
-func scanXUI() ([]XUICandidate, error) {
-	data, err := os.ReadFile(xuiDBPath)
+// ---- Dispatcher: SQLite, else text forward ∪ backward ----
+func scanXUI(path string) ([]XUICandidate, error) {
+	data, err := readSourceFile(path)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
 			return []XUICandidate{}, nil
 		}
 		return nil, err
 	}
-	fwd := scanForward(data)
-	bwd := scanBackward(data)
+	ins, dbErr := readXUIInbounds(path)
+	if dbErr == nil {
+		out := candidatesFromInbounds(ins)
+		log.Printf("[xui/sqlite] inbounds: %d, candidates: %d", len(ins), len(out))
+		return out, nil
+	}
+	log.Printf("[xui/sqlite] %v; falling back to text scan", dbErr)
 
+	out := dedupCandidates(append(scanForward(data), scanBackward(data)...))
+	log.Printf("[xui/text-strict] merged: %d", len(out))
+	return out, nil
+}
+
+func candidateKey(c XUICandidate) string {
+	if c.Type == "tls" {
+		return fmt.Sprintf("tls|%s|%d", strings.ToLower(c.SNI), c.Port)
+	}
+	return fmt.Sprintf("http|%s|%s|%d", strings.ToLower(c.Host), c.Path, c.Port)
+}
+
+// dedupCandidates keeps the first candidate for each route and port.
+func dedupCandidates(items []XUICandidate) []XUICandidate {
 	seen := map[string]bool{}
-	var out []XUICandidate
-	nextID := 1
-	push := func(c XUICandidate) {
-		key := ""
-		if c.Type == "tls" {
-			key = fmt.Sprintf("tls|%s|%d", strings.ToLower(c.SNI), c.Port)
-		} else {
-			key = fmt.Sprintf("http|%s|%s|%d", strings.ToLower(c.Host), c.Path, c.Port)
-		}
-		if !seen[key] {
-			c.ID = nextID
-			out = append(out, c)
+	out := []XUICandidate{}
+	for _, c := range items {
+		if key := candidateKey(c); !seen[key] {
 			seen[key] = true
-			nextID++
+			out = append(out, c)
 		}
 	}
-	for _, c := range fwd {
-		push(c)
+	return out
+}
+
+// candidateID derives a candidate's ID from what it routes, so an ID picked
+// from one scan names the same route in any later scan.
+func candidateID(c XUICandidate) string {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s|%s|%s|%s|%d", c.Type, strings.ToLower(c.Host), strings.ToLower(c.SNI), c.Path, c.Port)
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+func enabledCandidates(items []XUICandidate) []XUICandidate {
+	out := make([]XUICandidate, 0, len(items))
+	for _, it := range items {
+		if !it.Disabled {
+			out = append(out, it)
+		}
 	}
-	for _, c := range bwd {
-		push(c)
+	return out
+}
+
+func withCandidateIDs(items []XUICandidate) []XUICandidate {
+	for i := range items {
+		items[i].ID = candidateID(items[i])
 	}
+	return items
+}
 
-	log.Printf("[xui/text-strict] merged: %d", len(out))
-	return out, nil
+// xuiScanSnapshot is the last scan shown to the panel, kept in cachePath.
+// Apply works from it rather than rescanning, and refuses once the database
+// has changed underneath it.
+type xuiScanSnapshot struct {
+	UpdatedAt   string         `json:"updated_at"`
+	Source      string         `json:"source"`
+	Path        string         `json:"path"`
+	DBSignature string         `json:"db_signature"`
+	Items       []XUICandidate `json:"items"`
+}
+
+func loadScanSnapshot() (xuiScanSnapshot, error) {
+	var snap xuiScanSnapshot
+	b, err := os.ReadFile(cachePath)
+	if err != nil {
+		return snap, err
+	}
+	err = json.Unmarshal(b, &snap)
+	return snap, err
 }
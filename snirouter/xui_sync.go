@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	xuiSyncOff     = ""
+	xuiSyncQueue   = "queue"
+	xuiSyncManaged = "managed"
+
+	xuiPollInterval = 2 * time.Second
+	// x-ui writes the db (and its -wal) in bursts; wait for it to go quiet
+	xuiDebounce = 5 * time.Second
+)
+
+// xuiChanges is the difference between two scans, keyed by route
+// (SNI, or host+path).
+type xuiChanges struct {
+	Added   []XUICandidate `json:"added"`
+	Changed []XUICandidate `json:"changed"`
+	Removed []XUICandidate `json:"removed"`
+	// full scan the change set was computed from
+	Snapshot   []XUICandidate `json:"snapshot"`
+	DetectedAt string         `json:"detected_at"`
+}
+
+func (c xuiChanges) empty() bool {
+	return len(c.Added) == 0 && len(c.Changed) == 0 && len(c.Removed) == 0
+}
+
+type xuiSyncState struct {
+	Applied   []XUICandidate `json:"applied"`
+	Pending   *xuiChanges    `json:"pending,omitempty"`
+	// routes sync left alone because something else already routes them;
+	// offered again by every sync until the way is clear
+	Conflicts []XUICandidate `json:"conflicts,omitempty"`
+	LastSync  string         `json:"last_sync,omitempty"`
+	LastError string         `json:"last_error,omitempty"`
+}
+
+// xuiSyncMu serialises sync state updates. Take it before configMutex.
+var xuiSyncMu sync.Mutex
+
+func loadXUISyncState() (xuiSyncState, error) {
+	var st xuiSyncState
+	b, err := os.ReadFile(xuiSyncPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return st, err
+	}
+	if err := json.Unmarshal(b, &st); err != nil {
+		// e.g. written before candidate ids were strings; a fresh state
+		// just makes the next sync propose everything again
+		log.Printf("[xui/sync] discarding unreadable state: %v", err)
+		return xuiSyncState{}, nil
+	}
+	return st, nil
+}
+
+func saveXUISyncState(st xuiSyncState) error {
+	return writeAtomic(xuiSyncPath, mustJSON(st), 0644)
+}
+
+func validateXUISync(mode string) error {
+	switch mode {
+	case xuiSyncOff, xuiSyncQueue, xuiSyncManaged:
+		return nil
+	}
+	return fmt.Errorf("unknown sync mode %q", mode)
+}
+
+func xuiRouteKey(c XUICandidate) string {
+	if c.Type == "tls" {
+		return "tls|" + strings.ToLower(c.SNI)
+	}
+	return "http|" + strings.ToLower(c.Host) + "|" + c.Path
+}
+
+func diffCandidates(prev, cur []XUICandidate) xuiChanges {
+	old := map[string]XUICandidate{}
+	for _, c := range prev {
+		old[xuiRouteKey(c)] = c
+	}
+	var ch xuiChanges
+	seen := map[string]bool{}
+	for _, c := range cur {
+		k := xuiRouteKey(c)
+		seen[k] = true
+		p, ok := old[k]
+		switch {
+		case !ok:
+			ch.Added = append(ch.Added, c)
+		case p.Port != c.Port || p.Listen != c.Listen || p.ProxyProtocol != c.ProxyProtocol || p.Transport != c.Transport:
+			ch.Changed = append(ch.Changed, c)
+		}
+	}
+	for _, c := range prev {
+		if !seen[xuiRouteKey(c)] {
+			ch.Removed = append(ch.Removed, c)
+		}
+	}
+	return ch
+}
+
+// candidateUpstream is the address nginx reaches the inbound on: its listen
+// IP (loopback when it listens on all interfaces) or its unix socket. It
+// returns "" for inbounds nginx cannot connect to.
+func candidateUpstream(c XUICandidate) string {
+	l := c.Listen
+	if strings.HasPrefix(l, "/") {
+		// Xray allows "path,mode" to set the socket file permissions
+		if i := strings.LastIndexByte(l, ','); i >= 0 {
+			l = l[:i]
+		}
+		return "unix:" + l
+	}
+	if c.Port <= 0 || c.Port > 65535 || strings.HasPrefix(l, "@") {
+		return "" // abstract sockets are not supported by nginx
+	}
+	switch l {
+	case "", "0.0.0.0", "::", "[::]":
+		l = "127.0.0.1"
+	}
+	return net.JoinHostPort(strings.Trim(l, "[]"), strconv.Itoa(c.Port))
+}
+
+// applyCandidate merges one scan result into cfg and reports whether it was
+// usable. A route set up by hand stays manual even when overwritten.
+func applyCandidate(cfg *Config, it XUICandidate) bool {
+	up, src := candidateUpstream(it), candidateSource(it)
+	if up == "" {
+		return false
+	}
+	cur := it
+	annotateCandidate(cfg, &cur)
+	if cur.Status != candidateNew && cur.Overlap == "" && cur.ExistingSource == nil {
+		src = nil
+	}
+	if it.Type == "tls" && it.SNI != "" && validateSNI(it.SNI) == nil {
+		upsertMapping(&cfg.Mappings, Mapping{SNI: it.SNI, Upstream: up, ProxyProtocol: it.ProxyProtocol, Source: src})
+		return true
+	}
+	if it.Type == "http" && it.Host != "" {
+		upsertHTTPRoute(cfg, httpRouteInput{Host: it.Host, PathPrefix: it.Path, Upstream: up, Transport: it.Transport, Source: src})
+		return true
+	}
+	return false
+}
+
+// removeCandidate drops the route a vanished inbound had created, but only
+// while it is still sourced from that inbound; routes edited by hand since
+// are left alone.
+func removeCandidate(cfg *Config, it XUICandidate) bool {
+	removed := false
+	if it.Type == "tls" {
+		ms := cfg.Mappings[:0]
+		for _, m := range cfg.Mappings {
+			if strings.EqualFold(m.SNI, it.SNI) && m.ALPN == alpnAny && m.Source.is(it) {
+				removed = true
+				continue
+			}
+			ms = append(ms, m)
+		}
+		cfg.Mappings = ms
+		return removed
+	}
+
+	hosts := cfg.HTTPHosts[:0]
+	for _, h := range cfg.HTTPHosts {
+		if strings.EqualFold(h.Host, it.Host) {
+			ps := h.Paths[:0]
+			for _, p := range h.Paths {
+				if p.PathPrefix == it.Path && p.Source.is(it) {
+					removed = true
+					continue
+				}
+				ps = append(ps, p)
+			}
+			h.Paths = ps
+			if len(h.Paths) == 0 && h.Fallback == "" {
+				continue
+			}
+		}
+		hosts = append(hosts, h)
+	}
+	cfg.HTTPHosts = hosts
+	return removed
+}
+
+// syncable annotates it against cfg and reports whether sync may apply it:
+// its route must be new or one this inbound created. Manual routes, other
+// inbounds' routes and SNIs nginx cannot tell apart are for a person to
+// resolve.
+func syncable(cfg *Config, it *XUICandidate) bool {
+	annotateCandidate(cfg, it)
+	switch {
+	case it.Overlap != "":
+		return false
+	case it.Status == candidateNew:
+		return true
+	}
+	return it.ExistingSource.is(*it)
+}
+
+// holdConflicts takes what sync may not apply out of ch's additions and
+// changes, and out of its snapshot so the next sync offers them again, and
+// returns them.
+func holdConflicts(cfg *Config, ch *xuiChanges) []XUICandidate {
+	var held []XUICandidate
+	keep := func(items []XUICandidate) []XUICandidate {
+		var out []XUICandidate
+		for _, it := range items {
+			if syncable(cfg, &it) {
+				out = append(out, it)
+			} else {
+				held = append(held, it)
+			}
+		}
+		return out
+	}
+	ch.Added, ch.Changed = keep(ch.Added), keep(ch.Changed)
+	if len(held) == 0 {
+		return nil
+	}
+	skip := map[string]bool{}
+	for _, it := range held {
+		skip[xuiRouteKey(it)] = true
+	}
+	var snap []XUICandidate
+	for _, it := range ch.Snapshot {
+		if !skip[xuiRouteKey(it)] {
+			snap = append(snap, it)
+		}
+	}
+	ch.Snapshot = snap
+	return held
+}
+
+// commitXUIChanges applies ch to the config and reloads nginx. Caller holds
+// xuiSyncMu; st is updated to reflect the outcome. Conflicts are checked
+// again since the config may have changed while ch was queued.
+func commitXUIChanges(st *xuiSyncState, ch xuiChanges, author string) error {
+	configMutex.Lock()
+	cfg, err := loadConfig()
+	if err != nil {
+		configMutex.Unlock()
+		return err
+	}
+	held := holdConflicts(&cfg, &ch)
+	n := 0
+	for _, it := range append(append([]XUICandidate{}, ch.Added...), ch.Changed...) {
+		if applyCandidate(&cfg, it) {
+			n++
+		}
+	}
+	for _, it := range ch.Removed {
+		if removeCandidate(&cfg, it) {
+			n++
+		}
+	}
+	reason := fmt.Sprintf("x-ui sync (+%d ~%d -%d)", len(ch.Added), len(ch.Changed), len(ch.Removed))
+	if n > 0 {
+		if err := saveConfig(cfg, author, reason); err != nil {
+			configMutex.Unlock()
+			return err
+		}
+	}
+	configMutex.Unlock()
+
+	if n > 0 {
+		if err := applyAndReload(); err != nil {
+			st.LastError = err.Error()
+			return err
+		}
+	}
+	st.Applied = ch.Snapshot
+	st.Pending = nil
+	st.Conflicts = append(st.Conflicts, held...)
+	st.LastError = ""
+	log.Printf("[xui/sync] %s", reason)
+	return nil
+}
+
+// syncXUI rescans x-ui and, depending on the configured mode, applies the
+// difference to what was last applied or queues it for approval.
+func syncXUI() (err error) {
+	// it runs in the background; a database the reader chokes on must not
+	// take the panel down
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("sync aborted: %v", r)
+		}
+	}()
+	configMutex.Lock()
+	cfg, err := loadConfig()
+	configMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if cfg.XUISync == xuiSyncOff {
+		return nil
+	}
+
+	items, err := scanSource(xuiSource{}, xuiDBPath)
+	if err != nil {
+		return err
+	}
+	// a disabled inbound's route points at nothing, so it syncs as removed
+	items = enabledCandidates(items)
+
+	xuiSyncMu.Lock()
+	defer xuiSyncMu.Unlock()
+	st, err := loadXUISyncState()
+	if err != nil {
+		return err
+	}
+	st.LastSync = time.Now().UTC().Format(time.RFC3339)
+	ch := diffCandidates(st.Applied, items)
+	ch.Snapshot = items
+	ch.DetectedAt = st.LastSync
+	st.Conflicts = holdConflicts(&cfg, &ch)
+	if len(st.Conflicts) > 0 {
+		log.Printf("[xui/sync] left %d routes alone that are already routed elsewhere", len(st.Conflicts))
+	}
+
+	switch {
+	case ch.empty():
+		st.Pending = nil
+	case cfg.XUISync == xuiSyncManaged:
+		if err := commitXUIChanges(&st, ch, "x-ui sync"); err != nil {
+			log.Printf("[xui/sync] apply failed: %v", err)
+		}
+	default:
+		st.Pending = &ch
+		log.Printf("[xui/sync] queued +%d ~%d -%d for approval", len(ch.Added), len(ch.Changed), len(ch.Removed))
+	}
+	return saveXUISyncState(st)
+}
+
+// watchXUI polls the x-ui database and syncs once it has been quiet for
+// xuiDebounce after a change. The first poll always counts as a change so a
+// restart catches up with edits made while snirouter was down.
+func watchXUI() {
+	last, changedAt := "", time.Time{}
+	for range time.Tick(xuiPollInterval) {
+		if sig := pathSignature(xuiDBPath); sig != last {
+			last, changedAt = sig, time.Now()
+			continue
+		}
+		if changedAt.IsZero() || time.Since(changedAt) < xuiDebounce {
+			continue
+		}
+		changedAt = time.Time{}
+		if err := syncXUI(); err != nil {
+			log.Printf("[xui/sync] %v", err)
+		}
+	}
+}